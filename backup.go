@@ -0,0 +1,781 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"filippo.io/age"
+	"filippo.io/age/agessh"
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	power2 "github.com/filecoin-project/specs-actors/v2/actors/builtin/power"
+	"github.com/urfave/cli/v2"
+)
+
+// archiveVersion is the version of the backup archive format written by this
+// build. Version 0 archives have no manifest.
+const archiveVersion = 1
+
+const manifestName = "manifest.json"
+
+// archive names are backup-<time>.tar.gz, with .age appended when encrypted;
+// archives written before versioning lack the time
+const (
+	archivePrefix     = "backup"
+	archiveExt        = ".tar.gz"
+	archiveTimeLayout = "20060102T150405Z"
+)
+
+// backupRecipients are the age recipients backups are encrypted to
+var backupRecipients []string
+
+// backupAllowPlaintext allows backups to be written in plaintext when there
+// are no recipients
+var backupAllowPlaintext bool
+
+// backupIdentity is the age identity file used to decrypt backups
+var backupIdentity string
+
+// backupAllowUnverified allows archives without a manifest to be used
+var backupAllowUnverified bool
+
+var backupRecipientFlag = &cli.StringSliceFlag{
+	Name:    "recipient",
+	Usage:   "age recipient, or file of recipients, to encrypt backups to; may be repeated",
+	EnvVars: []string{"BACKUP_RECIPIENTS"},
+}
+
+var backupIdentityFlag = &cli.StringFlag{
+	Name:    "identity",
+	Usage:   "age identity file, or unencrypted ssh key, to decrypt backups with",
+	EnvVars: []string{"BACKUP_IDENTITY"},
+}
+
+var backupAllowPlaintextFlag = &cli.BoolFlag{
+	Name:    "allow-plaintext-backups",
+	Usage:   "write backups unencrypted when no --recipient is set, worker keys included",
+	EnvVars: []string{"BACKUP_ALLOW_PLAINTEXT"},
+}
+
+var backupAllowUnverifiedFlag = &cli.BoolFlag{
+	Name:  "allow-unverified",
+	Usage: "use backup archives that have no manifest to verify them against",
+}
+
+// checkBackupEncryption fails unless backups will be encrypted or plaintext
+// backups were explicitly allowed
+func checkBackupEncryption() error {
+	if len(backupRecipients) == 0 && !backupAllowPlaintext {
+		return fmt.Errorf("no backup recipients set; pass --recipient, or --allow-plaintext-backups to write worker keys unencrypted")
+	}
+	return nil
+}
+
+// backupFiles are the loose parts of a backup that go into the archive
+var backupFiles = []string{"bak", "keystore", "key", "lotusminer"}
+
+// ManifestFile is the checksum of a file in a backup archive
+type ManifestFile struct {
+	Name   string
+	Size   int64
+	SHA256 string
+}
+
+// CreateReceipt is the receipt of the CreateMiner message that created a
+// miner, the proof of which actor was created for the worker
+type CreateReceipt struct {
+	ExitCode int64
+	Return   []byte
+	GasUsed  int64
+}
+
+// BackupManifest describes the miner in a backup archive and the files that
+// make up its backup
+type BackupManifest struct {
+	Version       int
+	Created       time.Time
+	Worker        string
+	Miner         string         `json:",omitempty"`
+	Owner         string         `json:",omitempty"`
+	CreatedEpoch  abi.ChainEpoch `json:",omitempty"`
+	CreateMessage string         `json:",omitempty"`
+	CreateReceipt *CreateReceipt `json:",omitempty"`
+	DeadlineHour  *int           `json:",omitempty"`
+	Files         []ManifestFile
+}
+
+// ArchivePath returns the path of the miner's latest backup archive, or "" if
+// it has none
+func (s Miner) ArchivePath() string {
+	versions, err := s.BackupVersions()
+	if err != nil || len(versions) == 0 {
+		return ""
+	}
+	return versions[0].Path
+}
+
+// hasLooseBackup reports whether any part of the backup is still outside the
+// archive
+func (s Miner) hasLooseBackup() bool {
+	for _, name := range backupFiles {
+		if _, err := os.Stat(home(s.BackupDir(), name)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// newManifest checksums the loose backup files of the miner and fills in what
+// the inventory knows about it
+func (s Miner) newManifest() (*BackupManifest, error) {
+	m := &BackupManifest{
+		Version: archiveVersion,
+		Created: time.Now(),
+		Worker:  s.worker,
+		Miner:   s.id,
+		Owner:   s.owner,
+	}
+
+	inv, err := OpenInventory()
+	if err != nil {
+		return nil, err
+	}
+	if rec, err := inv.Get(s.worker); err == nil {
+		m.Miner = rec.Miner
+		m.Owner = rec.Owner
+		m.CreatedEpoch = rec.CreatedEpoch
+		m.CreateMessage = rec.Message
+		m.CreateReceipt = rec.Receipt
+		m.DeadlineHour = rec.DeadlineHour
+	}
+
+	dir := s.BackupDir()
+	for _, name := range backupFiles {
+		root := home(dir, name)
+		if _, err := os.Stat(root); os.IsNotExist(err) {
+			continue
+		}
+
+		err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil || !info.Mode().IsRegular() {
+				return err
+			}
+
+			sum, err := fileSHA256(path)
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(dir, path)
+			if err != nil {
+				return err
+			}
+
+			m.Files = append(m.Files, ManifestFile{
+				Name:   filepath.ToSlash(rel),
+				Size:   info.Size(),
+				SHA256: sum,
+			})
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("checksumming %s: %w", name, err)
+		}
+	}
+
+	return m, nil
+}
+
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Verify checks that every file in the manifest, and nothing else, was
+// extracted into dir unchanged, and that the creation receipt names the miner
+func (m *BackupManifest) Verify(dir string) error {
+	if m.Version > archiveVersion {
+		return fmt.Errorf("archive format version %d is newer than the supported version %d", m.Version, archiveVersion)
+	}
+
+	if r := m.CreateReceipt; r != nil {
+		if r.ExitCode != 0 {
+			return fmt.Errorf("CreateMiner message %s failed with exit code %d", m.CreateMessage, r.ExitCode)
+		}
+		var ret power2.CreateMinerReturn
+		if err := ret.UnmarshalCBOR(bytes.NewReader(r.Return)); err != nil {
+			return fmt.Errorf("decoding CreateMiner receipt: %w", err)
+		}
+		if m.Miner != "" {
+			// compare addresses, as their string form depends on the network
+			maddr, err := address.NewFromString(m.Miner)
+			if err != nil {
+				return fmt.Errorf("manifest has invalid miner %s: %w", m.Miner, err)
+			}
+			if maddr != ret.IDAddress {
+				return fmt.Errorf("CreateMiner receipt is for %s, not %s", ret.IDAddress, m.Miner)
+			}
+		}
+	}
+
+	// an archive without a manifest has nothing to check its files against
+	if m.Version == 0 {
+		if !backupAllowUnverified {
+			return fmt.Errorf("archive has no manifest; pass --allow-unverified to use it anyway")
+		}
+		return nil
+	}
+
+	listed := map[string]bool{manifestName: true}
+	for _, f := range m.Files {
+		listed[f.Name] = true
+	}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if !listed[filepath.ToSlash(rel)] {
+			return fmt.Errorf("%s is in the archive but not in the manifest", filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, f := range m.Files {
+		path := filepath.Join(dir, filepath.FromSlash(f.Name))
+		info, err := os.Stat(path)
+		if err != nil {
+			return fmt.Errorf("%s is missing from the archive", f.Name)
+		}
+		if info.Size() != f.Size {
+			return fmt.Errorf("%s is %d bytes, expected %d", f.Name, info.Size(), f.Size)
+		}
+
+		sum, err := fileSHA256(path)
+		if err != nil {
+			return err
+		}
+		if sum != f.SHA256 {
+			return fmt.Errorf("checksum of %s does not match the manifest", f.Name)
+		}
+	}
+	return nil
+}
+
+// ArchiveBackup packs the loose backup of the miner and a manifest into a
+// single archive, encrypted to backupRecipients, and removes the loose files.
+// It only writes a plaintext archive when backupAllowPlaintext is set. The
+// exported worker key is removed even when archiving fails, so callers export
+// it again before each attempt.
+func (s Miner) ArchiveBackup(ctx context.Context) (err error) {
+	// don't leave the worker's private key lying around in plaintext
+	defer func() {
+		if err != nil {
+			if rerr := os.Remove(home(s.BackupDir(), "key")); rerr != nil && !os.IsNotExist(rerr) {
+				log.Errorf("removing loose worker key of %s failed: %s", s.worker, rerr)
+			}
+		}
+	}()
+
+	if err := checkBackupEncryption(); err != nil {
+		return err
+	}
+
+	if !s.hasLooseBackup() {
+		if s.ArchivePath() != "" {
+			return nil
+		}
+		return fmt.Errorf("no backup of %s to archive", s.worker)
+	}
+
+	m, err := s.newManifest()
+	if err != nil {
+		return err
+	}
+	mb, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	path := home(s.BackupDir(), archivePrefix+"-"+m.Created.UTC().Format(archiveTimeLayout)+archiveExt)
+	if len(backupRecipients) > 0 {
+		path += ".age"
+	} else {
+		log.Infof("leaving the backup of %s unencrypted as allowed by --allow-plaintext-backups", s.worker)
+	}
+
+	if err := s.writeArchive(path+".tmp", mb); err != nil {
+		os.Remove(path + ".tmp")
+		return err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+
+	for _, name := range backupFiles {
+		if err := os.RemoveAll(home(s.BackupDir(), name)); err != nil {
+			return fmt.Errorf("error removing loose %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func (s Miner) writeArchive(path string, manifest []byte) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = f
+	var enc io.WriteCloser
+	if len(backupRecipients) > 0 {
+		rs, err := parseRecipients()
+		if err != nil {
+			f.Close()
+			return err
+		}
+		enc, err = age.Encrypt(f, rs...)
+		if err != nil {
+			f.Close()
+			return fmt.Errorf("error encrypting backup archive: %w", err)
+		}
+		w = enc
+	}
+
+	if err := writeTarGz(w, s.BackupDir(), backupFiles, manifest); err != nil {
+		f.Close()
+		return fmt.Errorf("error writing backup archive: %w", err)
+	}
+	if enc != nil {
+		if err := enc.Close(); err != nil {
+			f.Close()
+			return fmt.Errorf("error encrypting backup archive: %w", err)
+		}
+	}
+	return f.Close()
+}
+
+// parseRecipients parses backupRecipients, each an age or ssh public key or a
+// file of age recipients
+func parseRecipients() ([]age.Recipient, error) {
+	var rs []age.Recipient
+	for _, r := range backupRecipients {
+		switch {
+		case strings.HasPrefix(r, "age1"):
+			rcpt, err := age.ParseX25519Recipient(r)
+			if err != nil {
+				return nil, fmt.Errorf("parsing recipient %s: %w", r, err)
+			}
+			rs = append(rs, rcpt)
+		case strings.HasPrefix(r, "ssh-"):
+			rcpt, err := agessh.ParseRecipient(r)
+			if err != nil {
+				return nil, fmt.Errorf("parsing recipient %s: %w", r, err)
+			}
+			rs = append(rs, rcpt)
+		default:
+			f, err := os.Open(r)
+			if err != nil {
+				return nil, fmt.Errorf("opening recipients file: %w", err)
+			}
+			parsed, err := age.ParseRecipients(f)
+			f.Close()
+			if err != nil {
+				return nil, fmt.Errorf("parsing recipients file %s: %w", r, err)
+			}
+			rs = append(rs, parsed...)
+		}
+	}
+	return rs, nil
+}
+
+// loadIdentities reads backupIdentity, an age identity file or an unencrypted
+// ssh private key
+func loadIdentities() ([]age.Identity, error) {
+	b, err := ioutil.ReadFile(backupIdentity)
+	if err != nil {
+		return nil, fmt.Errorf("reading identity: %w", err)
+	}
+
+	if ids, err := age.ParseIdentities(bytes.NewReader(b)); err == nil {
+		return ids, nil
+	}
+	id, err := agessh.ParseIdentity(b)
+	if err != nil {
+		return nil, fmt.Errorf("parsing identity %s: %w", backupIdentity, err)
+	}
+	return []age.Identity{id}, nil
+}
+
+// OpenArchive extracts the backup archive at path into a private temporary
+// directory, decrypting it with backupIdentity if needed, and verifies it
+// against its manifest. The directory is removed by calling the returned
+// function.
+func OpenArchive(ctx context.Context, path string) (string, *BackupManifest, func(), error) {
+	dir, err := ioutil.TempDir("", "lotusbackup-")
+	if err != nil {
+		return "", nil, nil, err
+	}
+	cleanup := func() { os.RemoveAll(dir) }
+
+	if err := extractArchive(path, dir); err != nil {
+		cleanup()
+		return "", nil, nil, err
+	}
+
+	m := &BackupManifest{}
+	mb, err := ioutil.ReadFile(filepath.Join(dir, manifestName))
+	switch {
+	case os.IsNotExist(err):
+		if backupAllowUnverified {
+			log.Infof("archive %s has no manifest; using it unverified", path)
+		}
+	case err != nil:
+		cleanup()
+		return "", nil, nil, err
+	default:
+		if err := json.Unmarshal(mb, m); err != nil {
+			cleanup()
+			return "", nil, nil, fmt.Errorf("decoding manifest: %w", err)
+		}
+	}
+
+	if err := m.Verify(dir); err != nil {
+		cleanup()
+		return "", nil, nil, fmt.Errorf("verifying archive %s: %w", path, err)
+	}
+
+	return dir, m, cleanup, nil
+}
+
+func extractArchive(path, dir string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if strings.HasSuffix(path, ".age") {
+		if backupIdentity == "" {
+			return fmt.Errorf("%s is encrypted; please provide an identity with --identity", path)
+		}
+		ids, err := loadIdentities()
+		if err != nil {
+			return err
+		}
+		r, err = age.Decrypt(f, ids...)
+		if err != nil {
+			return fmt.Errorf("error decrypting backup: %w", err)
+		}
+	}
+
+	if err := readTarGz(r, dir); err != nil {
+		return fmt.Errorf("error reading backup archive: %w", err)
+	}
+	return nil
+}
+
+// OpenBackup returns the directory holding the plaintext backup of the miner:
+// its archive extracted into a temporary directory that is removed by calling
+// the returned function, or the backup directory itself for a loose backup.
+// Without either, the archive is downloaded from the backup targets.
+func (s Miner) OpenBackup(ctx context.Context) (string, func(), error) {
+	path := s.ArchivePath()
+	if path == "" && s.hasLooseBackup() {
+		return s.BackupDir(), func() {}, nil
+	}
+	if path == "" {
+		var err error
+		path, err = s.FetchBackup(ctx)
+		if err != nil {
+			return "", nil, err
+		}
+	}
+
+	dir, _, cleanup, err := OpenArchive(ctx, path)
+	if err != nil {
+		return "", nil, err
+	}
+	return dir, cleanup, nil
+}
+
+// writeTarGz writes manifest and the named files and directories under dir to
+// w as a gzipped tar, skipping names that don't exist
+func writeTarGz(w io.Writer, dir string, names []string, manifest []byte) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	err := tw.WriteHeader(&tar.Header{
+		Name:    manifestName,
+		Mode:    0600,
+		Size:    int64(len(manifest)),
+		ModTime: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := tw.Write(manifest); err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		root := filepath.Join(dir, name)
+		if _, err := os.Stat(root); os.IsNotExist(err) {
+			continue
+		}
+
+		err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+
+			hdr, err := tar.FileInfoHeader(info, "")
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(dir, path)
+			if err != nil {
+				return err
+			}
+			hdr.Name = filepath.ToSlash(rel)
+
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+			if !info.Mode().IsRegular() {
+				return nil
+			}
+
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+
+			_, err = io.Copy(tw, f)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// readTarGz extracts a gzipped tar from r into dir
+func readTarGz(r io.Reader, dir string) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(gz)
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		target := filepath.Join(dir, filepath.FromSlash(hdr.Name))
+		if !strings.HasPrefix(target, filepath.Clean(dir)+string(os.PathSeparator)) {
+			return fmt.Errorf("archive entry %s escapes the backup directory", hdr.Name)
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0700); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+				return err
+			}
+			f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(hdr.Mode).Perm()&0700)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(f, tr)
+			f.Close()
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+var restoreCmd = &cli.Command{
+	Name:  "restore",
+	Usage: "restore <worker|minerID|archive> rebuilds a ready-to-run miner repo from its backup",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "to",
+			Usage: "path of the miner repo to restore into (defaults to the miner's usual path)",
+		},
+		&cli.StringFlag{
+			Name:    "target-api",
+			Usage:   "host:port or multiaddr of the lotus node that will run the miner; the worker key is imported into it",
+			EnvVars: []string{"TARGET_LOTUS_API"},
+		},
+		&cli.StringFlag{
+			Name:    "target-token",
+			Usage:   "admin token of the target lotus node",
+			EnvVars: []string{"TARGET_LOTUS_TOKEN"},
+		},
+	},
+	Action: func(c *cli.Context) error {
+		ctx := context.Background()
+
+		if c.Args().Len() < 1 {
+			return fmt.Errorf("please provide a worker address, miner ID or a backup archive")
+		}
+
+		threshold := os.Getenv("THRESHOLD")
+		svc := NewService(ctx, threshold)
+		defer svc.closer()
+
+		path := c.Args().First()
+		if _, err := os.Stat(path); err != nil {
+			worker, err := resolveWorker(path)
+			if err != nil {
+				return err
+			}
+			svc.worker = worker
+			path = svc.ArchivePath()
+			if path == "" {
+				path, err = svc.FetchBackup(ctx)
+				if err != nil {
+					return fmt.Errorf("no local backup archive for worker %s: %w", svc.worker, err)
+				}
+			}
+		}
+
+		dir, m, cleanup, err := OpenArchive(ctx, path)
+		if err != nil {
+			return err
+		}
+		defer cleanup()
+
+		if m.Worker != "" {
+			svc.worker = m.Worker
+		}
+		if svc.worker == "" {
+			return fmt.Errorf("archive %s does not name its worker", path)
+		}
+
+		to := c.String("to")
+		if to == "" {
+			to = svc.MinerPath()
+		}
+		to, err = filepath.Abs(to)
+		if err != nil {
+			return err
+		}
+		if _, err := os.Stat(to); err == nil {
+			return fmt.Errorf("miner repo %s already exists", to)
+		}
+
+		// find the miner before restoring, as the repo's metadata is what
+		// may be wrong
+		var maddr address.Address
+		if m.Miner != "" {
+			maddr, err = address.NewFromString(m.Miner)
+		} else {
+			maddr, err = svc.ResolveMinerAddress(ctx)
+		}
+		if err != nil {
+			return fmt.Errorf("finding miner of %s failed: %w", svc.worker, err)
+		}
+
+		info, err := GetChainMinerInfo(ctx, svc.api, maddr)
+		if err != nil {
+			return err
+		}
+		if info.Worker != svc.worker {
+			return fmt.Errorf("worker of %s on chain is %s, not %s", maddr, info.Worker, svc.worker)
+		}
+
+		if err := svc.restoreFrom(ctx, dir, to); err != nil {
+			return fmt.Errorf("restoring miner failed: %w", err)
+		}
+		if err := writeRepoMinerAddress(ctx, to, maddr); err != nil {
+			return fmt.Errorf("fixing miner metadata failed: %w", err)
+		}
+
+		if target := c.String("target-api"); target != "" {
+			node, closer, err := lotusClient(ctx, target, c.String("target-token"))
+			if err != nil {
+				return fmt.Errorf("connecting with target lotus failed: %w", err)
+			}
+			defer closer()
+
+			if err := svc.ImportWorkerKey(ctx, node, home(dir, "key")); err != nil {
+				return err
+			}
+		} else {
+			log.Infof("no --target-api given, the worker key of %s was not imported", svc.worker)
+		}
+
+		// archives copied from another machine bring their miner along
+		inv, err := OpenInventory()
+		if err != nil {
+			return err
+		}
+		err = inv.Update(func(recs map[string]*MinerRecord) error {
+			if _, ok := recs[m.Worker]; ok || m.Worker == "" {
+				return nil
+			}
+			recs[m.Worker] = &MinerRecord{
+				Worker:       m.Worker,
+				Miner:        m.Miner,
+				Owner:        m.Owner,
+				CreatedEpoch: m.CreatedEpoch,
+				Message:      m.CreateMessage,
+				DeadlineHour: m.DeadlineHour,
+				Status:       StatusBackedUp,
+				Updated:      time.Now(),
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("export LOTUS_MINER_PATH=%s\n", to)
+		fmt.Println("export FULLNODE_API_INFO=<token of your lotus node>:<multiaddr of your lotus node>")
+		return nil
+	},
+}
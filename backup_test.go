@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/filecoin-project/go-address"
+	power2 "github.com/filecoin-project/specs-actors/v2/actors/builtin/power"
+	"github.com/mitchellh/go-homedir"
+)
+
+// manifestDir writes files into a temporary directory and returns it with a
+// manifest listing them
+func manifestDir(t *testing.T, files map[string]string) (string, *BackupManifest) {
+	dir := t.TempDir()
+	m := &BackupManifest{Version: archiveVersion, Worker: "f3worker", Miner: "f01234"}
+
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		sum, err := fileSHA256(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m.Files = append(m.Files, ManifestFile{Name: name, Size: int64(len(content)), SHA256: sum})
+	}
+	return dir, m
+}
+
+func createReceipt(t *testing.T, miner string) *CreateReceipt {
+	id, err := address.NewFromString(miner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ret := power2.CreateMinerReturn{IDAddress: id, RobustAddress: id}
+	var buf bytes.Buffer
+	if err := ret.MarshalCBOR(&buf); err != nil {
+		t.Fatal(err)
+	}
+	return &CreateReceipt{Return: buf.Bytes()}
+}
+
+func TestBackupManifestVerify(t *testing.T) {
+	files := map[string]string{"key": "worker key", "lotusminer/config.toml": "config"}
+
+	tests := []struct {
+		name    string
+		change  func(t *testing.T, dir string, m *BackupManifest)
+		wantErr bool
+	}{
+		{"intact", func(t *testing.T, dir string, m *BackupManifest) {}, false},
+		{"manifest in archive", func(t *testing.T, dir string, m *BackupManifest) {
+			if err := ioutil.WriteFile(filepath.Join(dir, manifestName), []byte("{}"), 0600); err != nil {
+				t.Fatal(err)
+			}
+		}, false},
+		{"matching receipt", func(t *testing.T, dir string, m *BackupManifest) {
+			m.CreateReceipt = createReceipt(t, "f01234")
+		}, false},
+		{"missing file", func(t *testing.T, dir string, m *BackupManifest) {
+			os.Remove(filepath.Join(dir, "key"))
+		}, true},
+		{"changed file", func(t *testing.T, dir string, m *BackupManifest) {
+			if err := ioutil.WriteFile(filepath.Join(dir, "key"), []byte("other key!"), 0600); err != nil {
+				t.Fatal(err)
+			}
+		}, true},
+		{"file not in manifest", func(t *testing.T, dir string, m *BackupManifest) {
+			if err := ioutil.WriteFile(filepath.Join(dir, "lotusminer/extra"), []byte("x"), 0600); err != nil {
+				t.Fatal(err)
+			}
+		}, true},
+		{"receipt of another miner", func(t *testing.T, dir string, m *BackupManifest) {
+			m.CreateReceipt = createReceipt(t, "f05678")
+		}, true},
+		{"failed receipt", func(t *testing.T, dir string, m *BackupManifest) {
+			m.CreateReceipt = &CreateReceipt{ExitCode: 16}
+		}, true},
+		{"newer version", func(t *testing.T, dir string, m *BackupManifest) {
+			m.Version = archiveVersion + 1
+		}, true},
+		{"no manifest", func(t *testing.T, dir string, m *BackupManifest) {
+			*m = BackupManifest{}
+		}, true},
+		{"no manifest, allowed", func(t *testing.T, dir string, m *BackupManifest) {
+			*m = BackupManifest{}
+			backupAllowUnverified = true
+			t.Cleanup(func() { backupAllowUnverified = false })
+		}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, m := manifestDir(t, files)
+			tt.change(t, dir, m)
+
+			err := m.Verify(dir)
+			if tt.wantErr && err == nil {
+				t.Error("Verify passed")
+			}
+			if !tt.wantErr && err != nil {
+				t.Errorf("Verify failed: %s", err)
+			}
+		})
+	}
+}
+
+func TestArchiveBackupFailureRemovesKey(t *testing.T) {
+	homedir.DisableCache = true
+	t.Cleanup(func() { homedir.DisableCache = false })
+	setenv(t, "HOME", t.TempDir())
+	setenv(t, "LOTUS_BACKUP_DIR", t.TempDir())
+
+	// a recipients file that doesn't exist fails the archive after the
+	// manifest is written
+	backupRecipients = []string{filepath.Join(t.TempDir(), "missing")}
+	t.Cleanup(func() { backupRecipients = nil })
+
+	s := NewMiner("f3owner", "f3worker", "f01234")
+	if err := os.MkdirAll(home(s.BackupDir(), "lotusminer"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"key", "lotusminer/config.toml"} {
+		if err := ioutil.WriteFile(home(s.BackupDir(), name), []byte(name), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := s.ArchiveBackup(context.Background()); err == nil {
+		t.Fatal("ArchiveBackup passed")
+	}
+	if _, err := os.Stat(home(s.BackupDir(), "key")); !os.IsNotExist(err) {
+		t.Errorf("loose key left behind: %v", err)
+	}
+	// the rest is kept for the next attempt
+	if _, err := os.Stat(home(s.BackupDir(), "lotusminer/config.toml")); err != nil {
+		t.Errorf("loose repo removed: %s", err)
+	}
+	if s.ArchivePath() != "" {
+		t.Errorf("failed archive %s left behind", s.ArchivePath())
+	}
+}
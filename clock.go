@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/filecoin-project/go-state-types/abi"
+	lotusapi "github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/build"
+)
+
+// EpochClock converts between epochs and wall-clock time on the network the
+// node is running
+type EpochClock struct {
+	Genesis    time.Time
+	BlockDelay time.Duration
+}
+
+// NewEpochClock reads the genesis time from the node. The block delay is
+// derived from the head's timestamp, as every block is stamped exactly
+// genesis + epoch * delay, so a node built for another network still gets it
+// right; a chain without blocks past genesis falls back to this build's delay.
+func NewEpochClock(ctx context.Context, api lotusapi.FullNode) (*EpochClock, error) {
+	gen, err := api.ChainGetGenesis(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("getting genesis: %w", err)
+	}
+
+	head, err := api.ChainHead(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("getting chain head: %w", err)
+	}
+
+	delay := uint64(build.BlockDelaySecs)
+	if head.Height() > 0 {
+		delay = (head.MinTimestamp() - gen.MinTimestamp()) / uint64(head.Height())
+	}
+
+	return &EpochClock{
+		Genesis:    time.Unix(int64(gen.MinTimestamp()), 0),
+		BlockDelay: time.Duration(delay) * time.Second,
+	}, nil
+}
+
+// Time returns the time at which epoch e starts
+func (c *EpochClock) Time(e abi.ChainEpoch) time.Time {
+	return c.Genesis.Add(time.Duration(e) * c.BlockDelay)
+}
+
+// Epoch returns the epoch that is running at t
+func (c *EpochClock) Epoch(t time.Time) abi.ChainEpoch {
+	d := t.Sub(c.Genesis)
+	e := abi.ChainEpoch(d / c.BlockDelay)
+	// round towards the earlier epoch for times before genesis
+	if d < 0 && d%c.BlockDelay != 0 {
+		e--
+	}
+	return e
+}
+
+// Duration returns how long n epochs take
+func (c *EpochClock) Duration(n abi.ChainEpoch) time.Duration {
+	return time.Duration(n) * c.BlockDelay
+}
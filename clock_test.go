@@ -0,0 +1,72 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/go-state-types/abi"
+)
+
+var mainnetClock = &EpochClock{
+	Genesis:    time.Unix(1598306400, 0),
+	BlockDelay: 30 * time.Second,
+}
+
+func TestEpochClockTime(t *testing.T) {
+	tests := []struct {
+		name  string
+		clock *EpochClock
+		epoch abi.ChainEpoch
+		want  time.Time
+	}{
+		{"genesis", mainnetClock, 0, time.Unix(1598306400, 0)},
+		{"first epoch", mainnetClock, 1, time.Unix(1598306430, 0)},
+		{"a day", mainnetClock, 2880, time.Unix(1598306400+86400, 0)},
+		{"before genesis", mainnetClock, -1, time.Unix(1598306370, 0)},
+		{"short block delay", &EpochClock{Genesis: time.Unix(1000, 0), BlockDelay: 4 * time.Second}, 10, time.Unix(1040, 0)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.clock.Time(tt.epoch); !got.Equal(tt.want) {
+				t.Errorf("Time(%d) = %s, want %s", tt.epoch, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEpochClockEpoch(t *testing.T) {
+	gen := mainnetClock.Genesis
+
+	tests := []struct {
+		name  string
+		clock *EpochClock
+		time  time.Time
+		want  abi.ChainEpoch
+	}{
+		{"genesis", mainnetClock, gen, 0},
+		{"end of first epoch", mainnetClock, gen.Add(29 * time.Second), 0},
+		{"start of second epoch", mainnetClock, gen.Add(30 * time.Second), 1},
+		{"a day", mainnetClock, gen.Add(24 * time.Hour), 2880},
+		{"just before genesis", mainnetClock, gen.Add(-time.Second), -1},
+		{"an epoch before genesis", mainnetClock, gen.Add(-30 * time.Second), -1},
+		{"past an epoch before genesis", mainnetClock, gen.Add(-31 * time.Second), -2},
+		{"short block delay", &EpochClock{Genesis: time.Unix(1000, 0), BlockDelay: 4 * time.Second}, time.Unix(1042, 0), 10},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.clock.Epoch(tt.time); got != tt.want {
+				t.Errorf("Epoch(%s) = %d, want %d", tt.time, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEpochClockRoundTrip(t *testing.T) {
+	for _, e := range []abi.ChainEpoch{-2880, -1, 0, 1, 1000000} {
+		if got := mainnetClock.Epoch(mainnetClock.Time(e)); got != e {
+			t.Errorf("Epoch(Time(%d)) = %d", e, got)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/mitchellh/go-homedir"
+	"github.com/urfave/cli/v2"
+)
+
+// Profile holds the settings for one network. Every setting maps to the
+// environment variable the rest of the tool reads, and a variable that is
+// already set wins over the profile.
+type Profile struct {
+	LotusAPI          string   `toml:"lotus_api"`
+	LotusToken        string   `toml:"lotus_token"`
+	MinerAPI          string   `toml:"miner_api"`
+	MinerToken        string   `toml:"miner_token"`
+	Owner             string   `toml:"owner"`
+	Threshold         string   `toml:"threshold"`
+	Budget            string   `toml:"budget"`
+	MaxFee            string   `toml:"max_fee"`
+	TradeWindows      []string `toml:"trade_windows"`
+	Timezone          string   `toml:"timezone"`
+	MinerPathPrefix   string   `toml:"miner_path_prefix"`
+	BackupDir         string   `toml:"backup_dir"`
+	BackupRecipients  []string `toml:"backup_recipients"`
+	BackupIdentity    string   `toml:"backup_identity"`
+	BackupPlaintext   bool     `toml:"backup_allow_plaintext"`
+	BackupTargets     []string `toml:"backup_targets"`
+	BackupKeepLast    int      `toml:"backup_keep_last"`
+	BackupKeepMonthly int      `toml:"backup_keep_monthly"`
+	SectorSize        string   `toml:"sector_size"`
+}
+
+// Config is the config file, with a profile per network. API addresses are
+// host:port or a multiaddr:
+//
+//	default = "mainnet"
+//
+//	[profile.mainnet]
+//	lotus_api = "/ip4/127.0.0.1/tcp/1234/http"
+//	owner = "f3..."
+//	threshold = "0.0000001"
+//	trade_windows = ["9:00AM-5:00PM@Europe/Berlin"]
+//
+//	[profile.calibnet]
+//	lotus_api = "10.0.0.2:1234"
+//	sector_size = "32GiB"
+type Config struct {
+	Default  string             `toml:"default"`
+	Profiles map[string]Profile `toml:"profile"`
+}
+
+var configFlag = &cli.StringFlag{
+	Name:    "config",
+	Usage:   "path of the config file",
+	EnvVars: []string{"FIL_MINER_BUYER_CONFIG"},
+	Value:   "~/.fil-miner-buyer/config.toml",
+}
+
+var profileFlag = &cli.StringFlag{
+	Name:    "profile",
+	Usage:   "config file profile to use, e.g. mainnet or calibnet (defaults to the file's default)",
+	EnvVars: []string{"FIL_MINER_BUYER_PROFILE"},
+}
+
+// env lists the environment variable each setting of the profile maps to
+func (p Profile) env() map[string]string {
+	itoa := func(n int) string {
+		if n == 0 {
+			return ""
+		}
+		return strconv.Itoa(n)
+	}
+	boolEnv := func(b bool) string {
+		if !b {
+			return ""
+		}
+		return "true"
+	}
+
+	return map[string]string{
+		"LOTUS_API":               p.LotusAPI,
+		"LOTUS_TOKEN":             p.LotusToken,
+		"LOTUSMINER_API":          p.MinerAPI,
+		"LOTUSMINER_TOKEN":        p.MinerToken,
+		"OWNER_ADDR":              p.Owner,
+		"THRESHOLD":               p.Threshold,
+		"BUDGET":                  p.Budget,
+		"MAX_FEE":                 p.MaxFee,
+		"TRADE_WINDOWS":           strings.Join(p.TradeWindows, ","),
+		"TRADE_TZ":                p.Timezone,
+		"LOTUS_MINER_PATH_PREFIX": p.MinerPathPrefix,
+		"LOTUS_BACKUP_DIR":        p.BackupDir,
+		"BACKUP_RECIPIENTS":       strings.Join(p.BackupRecipients, ","),
+		"BACKUP_IDENTITY":         p.BackupIdentity,
+		"BACKUP_ALLOW_PLAINTEXT":  boolEnv(p.BackupPlaintext),
+		"BACKUP_TARGETS":          strings.Join(p.BackupTargets, ","),
+		"BACKUP_KEEP_LAST":        itoa(p.BackupKeepLast),
+		"BACKUP_KEEP_MONTHLY":     itoa(p.BackupKeepMonthly),
+		"SECTOR_SIZE":             p.SectorSize,
+	}
+}
+
+// LoadConfig reads the config file at path. A missing file is an empty
+// config.
+func LoadConfig(path string) (*Config, error) {
+	path, err := homedir.Expand(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg Config
+	if _, err := toml.DecodeFile(path, &cfg); err != nil {
+		if os.IsNotExist(err) {
+			return &cfg, nil
+		}
+		return nil, fmt.Errorf("reading config %s: %w", path, err)
+	}
+	return &cfg, nil
+}
+
+// applyProfile exports the settings of the selected profile as environment
+// variables, leaving variables that are already set alone.
+func applyProfile(c *cli.Context) error {
+	cfg, err := LoadConfig(c.String("config"))
+	if err != nil {
+		return err
+	}
+
+	name := c.String("profile")
+	if name == "" {
+		name = cfg.Default
+	}
+	if name == "" {
+		return nil
+	}
+
+	p, ok := cfg.Profiles[name]
+	if !ok {
+		return fmt.Errorf("no profile %q in %s", name, c.String("config"))
+	}
+	log.Debugf("using profile %s", name)
+
+	for key, value := range p.env() {
+		if value == "" {
+			continue
+		}
+		if _, set := os.LookupEnv(key); set {
+			continue
+		}
+		if err := os.Setenv(key, value); err != nil {
+			return err
+		}
+	}
+
+	// global flags are parsed before the profile is applied
+	globals := map[string]string{
+		"max-fee":                 "MAX_FEE",
+		"recipient":               "BACKUP_RECIPIENTS",
+		"identity":                "BACKUP_IDENTITY",
+		"allow-plaintext-backups": "BACKUP_ALLOW_PLAINTEXT",
+		"backup-target":           "BACKUP_TARGETS",
+	}
+	for flag, key := range globals {
+		if c.IsSet(flag) || os.Getenv(key) == "" {
+			continue
+		}
+		for _, v := range strings.Split(os.Getenv(key), ",") {
+			if err := c.Set(flag, v); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	lotusapi "github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/urfave/cli/v2"
+)
+
+// maxFee caps the fee of every message the tool pushes; zero means the node's
+// default applies
+var maxFee = big.Zero()
+
+var maxFeeFlag = &cli.StringFlag{
+	Name:    "max-fee",
+	Usage:   "most to pay in fees for any single message, e.g. 0.07FIL",
+	EnvVars: []string{"MAX_FEE"},
+}
+
+// setMaxFee sets maxFee from the --max-fee flag if it was given.
+func setMaxFee(c *cli.Context) error {
+	if !c.IsSet("max-fee") {
+		return nil
+	}
+
+	fee, err := types.ParseFIL(c.String("max-fee"))
+	if err != nil {
+		return fmt.Errorf("parsing max fee failed: %w", err)
+	}
+	maxFee = abi.TokenAmount(fee)
+
+	return nil
+}
+
+// PushMessage pushes msg with maxFee as its MessageSendSpec.MaxFee. The
+// message is refused before it is pushed if the node expects it to cost more
+// than maxFee.
+func PushMessage(ctx context.Context, api lotusapi.FullNode, msg *types.Message) (*types.SignedMessage, error) {
+	if maxFee.IsZero() {
+		return api.MpoolPushMessage(ctx, msg, nil)
+	}
+
+	cost, err := EstimateMessageCost(ctx, api, msg)
+	if err != nil {
+		return nil, err
+	}
+	if cost.Total().GreaterThan(maxFee) {
+		return nil, fmt.Errorf("estimated fee %s exceeds max fee %s", types.FIL(cost.Total()), types.FIL(maxFee))
+	}
+
+	return api.MpoolPushMessage(ctx, msg, &lotusapi.MessageSendSpec{MaxFee: maxFee})
+}
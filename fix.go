@@ -10,69 +10,115 @@ import (
 	"github.com/ipfs/go-datastore"
 )
 
-func (s Miner) GetDatastore(ctx context.Context) (repo.LockedRepo, error) {
-	r, err := repo.NewFS(os.Getenv("LOTUS_MINER_PATH"))
+// getMinerMetadata reads the miner address from the metadata of the repo at
+// LOTUS_MINER_PATH
+func (s Miner) getMinerMetadata(ctx context.Context) (string, error) {
+	addr, err := readRepoMinerAddress(ctx, os.Getenv("LOTUS_MINER_PATH"))
+	if err != nil {
+		return "", err
+	}
+	return addr.String(), nil
+}
+
+// fixMinerMetadata sets the miner address in the metadata of the repo at
+// LOTUS_MINER_PATH to the miner's ID
+func (s Miner) fixMinerMetadata(ctx context.Context) error {
+	addr, err := address.NewFromString(s.id)
+	if err != nil {
+		return fmt.Errorf("invalid address: %w", err)
+	}
+	return writeRepoMinerAddress(ctx, os.Getenv("LOTUS_MINER_PATH"), addr)
+}
+
+// readRepoMinerAddress reads the miner address from the metadata datastore of
+// the miner repo at path
+func readRepoMinerAddress(ctx context.Context, path string) (address.Address, error) {
+	r, err := repo.NewFS(path)
 	if err != nil {
-		return nil, err
+		return address.Undef, err
 	}
 
 	ok, err := r.Exists()
 	if err != nil {
-		return nil, err
+		return address.Undef, err
 	}
 	if !ok {
-		return nil, fmt.Errorf("repo at '%s' is not initialized, run 'lotus-miner init' to set it up", s.MinerPath())
+		return address.Undef, fmt.Errorf("no miner repo at %s", path)
 	}
 
 	lr, err := r.Lock(repo.StorageMiner)
 	if err != nil {
-		return nil, err
+		return address.Undef, err
 	}
+	defer lr.Close()
 
-	return lr, nil
-}
-
-func (s Miner) getMinerMetadata(ctx context.Context) (string, error) {
-	lr, err := s.GetDatastore(ctx)
+	mds, err := lr.Datastore(ctx, "/metadata")
 	if err != nil {
-		return "", err
+		return address.Undef, err
 	}
 
-	mds, err := lr.Datastore(ctx, "/metadata")
+	addrb, err := mds.Get(datastore.NewKey("miner-address"))
 	if err != nil {
-		return "", err
+		return address.Undef, err
 	}
 
-	addrb, err := mds.Get(datastore.NewKey("miner-address"))
+	return address.NewFromBytes(addrb)
+}
+
+// writeRepoMinerAddress sets the miner address in the metadata datastore of
+// the miner repo at path
+func writeRepoMinerAddress(ctx context.Context, path string, maddr address.Address) error {
+	r, err := repo.NewFS(path)
 	if err != nil {
-		return "", err
+		return err
 	}
 
-	addr, err := address.NewFromBytes(addrb)
+	ok, err := r.Exists()
 	if err != nil {
-		return "", err
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("repo at '%s' is not initialized, run 'lotus-miner init' to set it up", path)
 	}
-	return addr.String(), nil
-}
 
-func (s Miner) fixMinerMetadata(ctx context.Context) error {
-	lr, err := s.GetDatastore(ctx)
+	lr, err := r.Lock(repo.StorageMiner)
 	if err != nil {
 		return err
 	}
+	defer lr.Close()
 
 	mds, err := lr.Datastore(ctx, "/metadata")
 	if err != nil {
 		return err
 	}
 
-	addr, err := address.NewFromString(s.id)
+	return mds.Put(datastore.NewKey("miner-address"), maddr.Bytes())
+}
+
+// ResolveMinerAddress finds the miner of a worker through the inventory, then
+// through the metadata of its repo or of its backed up repo
+func (s Miner) ResolveMinerAddress(ctx context.Context) (address.Address, error) {
+	inv, err := OpenInventory()
 	if err != nil {
-		return fmt.Errorf("invalid address: %w", err)
+		return address.Undef, err
 	}
-	if err := mds.Put(datastore.NewKey("miner-address"), addr.Bytes()); err != nil {
-		return err
+	if rec, err := inv.Get(s.worker); err == nil && rec.Miner != "" {
+		return address.NewFromString(rec.Miner)
+	}
+
+	if maddr, err := readRepoMinerAddress(ctx, s.MinerPath()); err == nil {
+		return maddr, nil
+	}
+
+	dir, cleanup, err := s.OpenBackup(ctx)
+	if err != nil {
+		return address.Undef, err
 	}
+	defer cleanup()
 
-	return nil
+	maddr, err := readRepoMinerAddress(ctx, home(dir, "lotusminer"))
+	if err != nil {
+		return address.Undef, fmt.Errorf("no miner found for worker %s: %w", s.worker, err)
+	}
+	return maddr, nil
 }
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	lotusapi "github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/ipfs/go-cid"
+	crypto "github.com/libp2p/go-libp2p-core/crypto"
+	peer "github.com/libp2p/go-libp2p-core/peer"
+)
+
+// MessageCost is the expected cost of landing a message
+type MessageCost struct {
+	BaseFee    abi.TokenAmount
+	GasLimit   int64
+	GasPremium abi.TokenAmount
+	GasFeeCap  abi.TokenAmount
+}
+
+// Total returns base fee × gas limit + premium × gas limit
+func (c *MessageCost) Total() abi.TokenAmount {
+	return big.Mul(big.Add(c.BaseFee, c.GasPremium), big.NewInt(c.GasLimit))
+}
+
+// Max returns the most the message can cost, fee cap × gas limit
+func (c *MessageCost) Max() abi.TokenAmount {
+	return big.Mul(c.GasFeeCap, big.NewInt(c.GasLimit))
+}
+
+// EstimateCreateMinerCost estimates what a CreateMiner message from the owner
+// would cost if it were pushed now.
+func (s *Service) EstimateCreateMinerCost(ctx context.Context) (*MessageCost, error) {
+	owner, err := address.NewFromString(s.owner)
+	if err != nil {
+		return nil, fmt.Errorf("parsing owner address: %w", err)
+	}
+
+	// the message is executed during estimation, so the worker has to be a
+	// BLS account that already exists on chain
+	worker, err := s.estimationWorker(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	sk, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	peerid, err := peer.IDFromPrivateKey(sk)
+	if err != nil {
+		return nil, err
+	}
+
+	msg, err := CreateMinerMessage(ctx, s.api, owner, worker, peerid)
+	if err != nil {
+		return nil, err
+	}
+
+	return EstimateMessageCost(ctx, s.api, msg)
+}
+
+// EstimateMessageCost estimates what msg would cost if it were pushed now.
+func EstimateMessageCost(ctx context.Context, api lotusapi.FullNode, msg *types.Message) (*MessageCost, error) {
+	head, err := api.ChainHead(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("getting chain head: %w", err)
+	}
+
+	est, err := api.GasEstimateMessageGas(ctx, msg, nil, head.Key())
+	if err != nil {
+		return nil, fmt.Errorf("estimating message gas: %w", err)
+	}
+
+	return &MessageCost{
+		BaseFee:    head.Blocks()[0].ParentBaseFee,
+		GasLimit:   est.GasLimit,
+		GasPremium: est.GasPremium,
+		GasFeeCap:  est.GasFeeCap,
+	}, nil
+}
+
+// MessageGasCost returns the total gas paid for a message that has landed and
+// the epoch at which it was executed.
+func MessageGasCost(ctx context.Context, api lotusapi.FullNode, c cid.Cid) (abi.TokenAmount, abi.ChainEpoch, error) {
+	lookup, err := api.StateSearchMsg(ctx, types.EmptyTSK, c, lotusapi.LookbackNoLimit, true)
+	if err != nil {
+		return big.Zero(), 0, fmt.Errorf("searching for message: %w", err)
+	}
+	if lookup == nil {
+		return big.Zero(), 0, fmt.Errorf("message %s not found on chain", c)
+	}
+
+	res, err := api.StateReplay(ctx, types.EmptyTSK, lookup.Message)
+	if err != nil {
+		return big.Zero(), lookup.Height, fmt.Errorf("replaying message: %w", err)
+	}
+
+	return res.GasCost.TotalCost, lookup.Height, nil
+}
+
+// estimationWorker returns a BLS address from the node's wallet that already
+// exists on chain, such as the worker of a previously bought miner, falling
+// back to the owner itself when it is a BLS address.
+func (s *Service) estimationWorker(ctx context.Context) (address.Address, error) {
+	if s.estWorker != address.Undef {
+		return s.estWorker, nil
+	}
+
+	addrs, err := s.api.WalletList(ctx)
+	if err != nil {
+		return address.Undef, fmt.Errorf("listing wallet addresses: %w", err)
+	}
+
+	for _, addr := range addrs {
+		if addr.Protocol() != address.BLS {
+			continue
+		}
+		if _, err := s.api.StateLookupID(ctx, addr, types.EmptyTSK); err != nil {
+			continue
+		}
+		s.estWorker = addr
+		return addr, nil
+	}
+
+	// the owner pays for every purchase, so it is on chain
+	owner, err := address.NewFromString(s.owner)
+	if err == nil && owner.Protocol() == address.BLS {
+		s.estWorker = owner
+		return owner, nil
+	}
+
+	return address.Undef, fmt.Errorf("no on-chain BLS address in the wallet to estimate CreateMiner gas with; send some FIL to a new BLS address or use a BLS owner")
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/lotus/chain/store"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/mitchellh/go-homedir"
+	"github.com/urfave/cli/v2"
+)
+
+// GasSample is the gas price observed at a single epoch
+type GasSample struct {
+	Epoch   abi.ChainEpoch
+	Time    time.Time
+	BaseFee abi.TokenAmount
+	Premium abi.TokenAmount
+}
+
+// Price returns the price per unit of gas, base fee plus premium
+func (g GasSample) Price() abi.TokenAmount {
+	return big.Add(g.BaseFee, g.Premium)
+}
+
+// GasHistory stores gas samples as JSON lines, one file per day, so that a
+// recorder can keep appending while buy reads the history.
+type GasHistory struct {
+	dir string
+}
+
+// OpenGasHistory opens the gas history in ~/.fil-miner-buyer/gas
+func OpenGasHistory() (*GasHistory, error) {
+	h, err := homedir.Dir()
+	if err != nil {
+		return nil, fmt.Errorf("getting home directory failed: %w", err)
+	}
+
+	dir := home(h, ".fil-miner-buyer/gas")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("error creating gas history directory: %w", err)
+	}
+
+	return &GasHistory{dir: dir}, nil
+}
+
+func (g *GasHistory) file(t time.Time) string {
+	return filepath.Join(g.dir, t.UTC().Format("2006-01-02")+".jsonl")
+}
+
+// Put appends a sample to the history
+func (g *GasHistory) Put(sample GasSample) error {
+	b, err := json.Marshal(sample)
+	if err != nil {
+		return err
+	}
+
+	return AppendFile(g.file(sample.Time), append(b, '\n'))
+}
+
+// Since returns all samples taken at or after t
+func (g *GasHistory) Since(t time.Time) ([]GasSample, error) {
+	var samples []GasSample
+	for day := t.UTC().Truncate(24 * time.Hour); !day.After(time.Now().UTC()); day = day.Add(24 * time.Hour) {
+		f, err := os.Open(g.file(day))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		sc := bufio.NewScanner(f)
+		for sc.Scan() {
+			var sample GasSample
+			if err := json.Unmarshal(sc.Bytes(), &sample); err != nil {
+				// a recorder may be halfway through appending the last line
+				continue
+			}
+			if sample.Time.Before(t) {
+				continue
+			}
+			samples = append(samples, sample)
+		}
+		err = sc.Err()
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return samples, nil
+}
+
+// SampleGas samples the base fee and the premium estimated for the owner at ts
+func (s *Service) SampleGas(ctx context.Context, ts *types.TipSet) (GasSample, error) {
+	addr, err := address.NewFromString(s.owner)
+	if err != nil {
+		return GasSample{}, fmt.Errorf("parsing owner address: %w", err)
+	}
+
+	premium, err := s.api.GasEstimateGasPremium(ctx, 2, addr, 10000, ts.Key())
+	if err != nil {
+		return GasSample{}, fmt.Errorf("estimating gas premium: %w", err)
+	}
+
+	return GasSample{
+		Epoch:   ts.Height(),
+		Time:    time.Unix(int64(ts.MinTimestamp()), 0),
+		BaseFee: ts.Blocks()[0].ParentBaseFee,
+		Premium: premium,
+	}, nil
+}
+
+// RecordGas samples gas into the history on every new tipset until ctx is
+// cancelled.
+func (s *Service) RecordGas(ctx context.Context, hist *GasHistory) error {
+	notifs, err := s.api.ChainNotify(ctx)
+	if err != nil {
+		return fmt.Errorf("subscribing to chain head changes failed: %w", err)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case changes, ok := <-notifs:
+			if !ok {
+				if ctx.Err() != nil {
+					return nil
+				}
+				return fmt.Errorf("chain notify channel closed")
+			}
+
+			for _, hc := range changes {
+				if hc.Type != store.HCApply && hc.Type != store.HCCurrent {
+					continue
+				}
+
+				sample, err := s.SampleGas(ctx, hc.Val)
+				if err != nil {
+					log.Errorf("sampling gas at epoch %d failed: %s", hc.Val.Height(), err)
+					continue
+				}
+				if err := hist.Put(sample); err != nil {
+					log.Errorf("recording gas at epoch %d failed: %s", sample.Epoch, err)
+				}
+			}
+		}
+	}
+}
+
+// IsGasPriceBelowPercentile checks if the current gas price is below the
+// configured percentile of the prices recorded within the history window.
+func (s *Service) IsGasPriceBelowPercentile(ctx context.Context) bool {
+	samples, err := s.gasHistory.Since(time.Now().Add(-s.historyWindow))
+	if err != nil {
+		log.Infof("reading gas history failed: %s", err)
+		return false
+	}
+	if len(samples) == 0 {
+		log.Info("no gas history recorded within the window")
+		return false
+	}
+
+	head, err := s.api.ChainHead(ctx)
+	if err != nil {
+		log.Infof("getting chain head failed: %s", err)
+		return false
+	}
+
+	curr, err := s.SampleGas(ctx, head)
+	if err != nil {
+		log.Infof("sampling gas failed: %s", err)
+		return false
+	}
+
+	prices := make([]abi.TokenAmount, len(samples))
+	for i, sample := range samples {
+		prices[i] = sample.Price()
+	}
+	limit := percentile(prices, s.percentile)
+
+	fmt.Printf("gas price: %s (p%g over %d samples: %s)\n", curr.Price(), s.percentile, len(samples), limit)
+	return curr.Price().LessThan(limit)
+}
+
+// percentile returns the p-th percentile of vals using the nearest-rank method
+func percentile(vals []abi.TokenAmount, p float64) abi.TokenAmount {
+	if len(vals) == 0 {
+		return big.Zero()
+	}
+
+	sorted := make([]abi.TokenAmount, len(vals))
+	copy(sorted, vals)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].LessThan(sorted[j])
+	})
+
+	rank := int(p/100*float64(len(sorted))+0.5) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	if rank >= len(sorted) {
+		rank = len(sorted) - 1
+	}
+	return sorted[rank]
+}
+
+// parseWindow parses a positive duration that may also be given in days,
+// e.g. 7d
+func parseWindow(s string) (time.Duration, error) {
+	var d time.Duration
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil {
+			return 0, fmt.Errorf("invalid window %q: %w", s, err)
+		}
+		d = time.Duration(days) * 24 * time.Hour
+	} else {
+		var err error
+		d, err = time.ParseDuration(s)
+		if err != nil {
+			return 0, fmt.Errorf("invalid window %q: %w", s, err)
+		}
+	}
+
+	if d <= 0 {
+		return 0, fmt.Errorf("invalid window %q: must be positive", s)
+	}
+	return d, nil
+}
+
+var gasCmd = &cli.Command{
+	Name:  "gas",
+	Usage: "record and inspect gas price history",
+	Subcommands: []*cli.Command{
+		gasRecordCmd,
+		gasStatsCmd,
+	},
+}
+
+var gasRecordCmd = &cli.Command{
+	Name:  "record",
+	Usage: "sample the gas price on every new tipset",
+	Action: func(c *cli.Context) error {
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		threshold := os.Getenv("THRESHOLD")
+		svc := NewService(ctx, threshold)
+		defer svc.closer()
+
+		hist, err := OpenGasHistory()
+		if err != nil {
+			return err
+		}
+
+		log.Info("recording gas history")
+		return svc.RecordGas(ctx, hist)
+	},
+}
+
+var gasStatsCmd = &cli.Command{
+	Name:  "stats",
+	Usage: "show gas price percentiles by hour of day",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "window",
+			Usage: "how far back to look, e.g. 24h or 7d",
+			Value: "7d",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		window, err := parseWindow(c.String("window"))
+		if err != nil {
+			return err
+		}
+
+		hist, err := OpenGasHistory()
+		if err != nil {
+			return err
+		}
+
+		samples, err := hist.Since(time.Now().Add(-window))
+		if err != nil {
+			return err
+		}
+
+		var basefees, premiums [24][]abi.TokenAmount
+		for _, sample := range samples {
+			h := sample.Time.Hour()
+			basefees[h] = append(basefees[h], sample.BaseFee)
+			premiums[h] = append(premiums[h], sample.Premium)
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 2, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "HOUR\tSAMPLES\tBASEFEE P10\tBASEFEE P50\tBASEFEE P90\tPREMIUM P10\tPREMIUM P50\tPREMIUM P90")
+		for h := 0; h < 24; h++ {
+			if len(basefees[h]) == 0 {
+				continue
+			}
+			fmt.Fprintf(tw, "%02d\t%d\t%s\t%s\t%s\t%s\t%s\t%s\n", h, len(basefees[h]),
+				percentile(basefees[h], 10), percentile(basefees[h], 50), percentile(basefees[h], 90),
+				percentile(premiums[h], 10), percentile(premiums[h], 50), percentile(premiums[h], 90))
+		}
+		return tw.Flush()
+	},
+}
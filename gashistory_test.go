@@ -0,0 +1,81 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+)
+
+func TestPercentile(t *testing.T) {
+	amounts := func(vals ...int64) []abi.TokenAmount {
+		var as []abi.TokenAmount
+		for _, v := range vals {
+			as = append(as, big.NewInt(v))
+		}
+		return as
+	}
+	ten := amounts(10, 1, 9, 2, 8, 3, 7, 4, 6, 5)
+
+	tests := []struct {
+		name string
+		vals []abi.TokenAmount
+		p    float64
+		want int64
+	}{
+		{"empty", nil, 50, 0},
+		{"single", amounts(7), 50, 7},
+		{"p0", ten, 0, 1},
+		{"p100", ten, 100, 10},
+		{"p50", ten, 50, 5},
+		{"p10", ten, 10, 1},
+		{"p11", ten, 11, 1},
+		{"p15 rounds up", ten, 15, 2},
+		{"p90", ten, 90, 9},
+		{"p99", ten, 99, 10},
+		{"duplicates", amounts(3, 3, 3, 1), 50, 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := percentile(tt.vals, tt.p); !got.Equals(big.NewInt(tt.want)) {
+				t.Errorf("percentile(p%g) = %s, want %d", tt.p, got, tt.want)
+			}
+		})
+	}
+
+	// the samples are sorted in a copy
+	if !ten[0].Equals(big.NewInt(10)) {
+		t.Error("percentile reordered its input")
+	}
+}
+
+func TestParseWindow(t *testing.T) {
+	tests := []struct {
+		in   string
+		want time.Duration
+	}{
+		{"7d", 7 * 24 * time.Hour},
+		{"1d", 24 * time.Hour},
+		{"24h", 24 * time.Hour},
+		{"90m", 90 * time.Minute},
+		{"1h30m", 90 * time.Minute},
+	}
+	for _, tt := range tests {
+		got, err := parseWindow(tt.in)
+		if err != nil {
+			t.Errorf("parseWindow(%q): %s", tt.in, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseWindow(%q) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+
+	for _, in := range []string{"", "7", "d", "-1d", "0d", "-1h", "0s", "1.5d", "7 d", "week"} {
+		if got, err := parseWindow(in); err == nil {
+			t.Errorf("parseWindow(%q) = %s, want an error", in, got)
+		}
+	}
+}
@@ -1,6 +1,8 @@
 module github.com/lanzafame/fil-miner-buyer
 
 require (
+	filippo.io/age v1.0.0
+	github.com/BurntSushi/toml v0.3.1
 	github.com/docker/go-units v0.4.0
 	github.com/filecoin-project/go-address v0.0.6
 	github.com/filecoin-project/go-jsonrpc v0.1.4-0.20210217175800-45ea43ac2bec
@@ -8,10 +10,11 @@ require (
 	github.com/filecoin-project/lotus v1.11.1
 	github.com/filecoin-project/specs-actors v0.9.14
 	github.com/filecoin-project/specs-actors/v2 v2.3.5
-	github.com/hako/durafmt v0.0.0-20200710122514-c0fb7b4da026
+	github.com/ipfs/go-cid v0.0.7
 	github.com/ipfs/go-datastore v0.4.5
 	github.com/ipfs/go-log/v2 v2.3.0
 	github.com/libp2p/go-libp2p-core v0.8.6
+	github.com/minio/blake2b-simd v0.0.0-20160723061019-3f5f724cb5b1
 	github.com/mitchellh/go-homedir v1.1.0
 	github.com/urfave/cli/v2 v2.2.0
 	golang.org/x/xerrors v0.0.0-20200804184101-5ec99f83aff1
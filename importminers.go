@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	lotusapi "github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/chain/actors/builtin/power"
+	"github.com/filecoin-project/lotus/chain/types"
+	power2 "github.com/filecoin-project/specs-actors/v2/actors/builtin/power"
+	"github.com/urfave/cli/v2"
+)
+
+// FindMinersByOwner scans every miner on chain for the ones owned by owner.
+func FindMinersByOwner(ctx context.Context, api lotusapi.FullNode, owner address.Address) ([]address.Address, error) {
+	ownerID, err := api.StateLookupID(ctx, owner, types.EmptyTSK)
+	if err != nil {
+		return nil, fmt.Errorf("looking up owner: %w", err)
+	}
+
+	head, err := api.ChainHead(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("getting chain head: %w", err)
+	}
+
+	miners, err := api.StateListMiners(ctx, head.Key())
+	if err != nil {
+		return nil, fmt.Errorf("listing miners: %w", err)
+	}
+	log.Infof("scanning %d miners for owner %s", len(miners), ownerID)
+
+	var (
+		mu    sync.Mutex
+		owned []address.Address
+		wg    sync.WaitGroup
+	)
+	todo := make(chan address.Address)
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for maddr := range todo {
+				mi, err := api.StateMinerInfo(ctx, maddr, head.Key())
+				if err != nil {
+					log.Infof("getting miner info of %s failed: %s", maddr, err)
+					continue
+				}
+				if mi.Owner != ownerID {
+					continue
+				}
+
+				mu.Lock()
+				owned = append(owned, maddr)
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, maddr := range miners {
+		todo <- maddr
+	}
+	close(todo)
+	wg.Wait()
+
+	return owned, nil
+}
+
+// FindMinersCreatedBy walks the CreateMiner messages owner sent since epoch
+// and returns the miners they created that owner still owns.
+func FindMinersCreatedBy(ctx context.Context, api lotusapi.FullNode, owner address.Address, since abi.ChainEpoch) ([]address.Address, error) {
+	ownerID, err := api.StateLookupID(ctx, owner, types.EmptyTSK)
+	if err != nil {
+		return nil, fmt.Errorf("looking up owner: %w", err)
+	}
+
+	msgs, err := api.StateListMessages(ctx, &lotusapi.MessageMatch{From: owner, To: power.Address}, types.EmptyTSK, since)
+	if err != nil {
+		return nil, fmt.Errorf("listing messages: %w", err)
+	}
+
+	var created []address.Address
+	for _, c := range msgs {
+		msg, err := api.ChainGetMessage(ctx, c)
+		if err != nil {
+			return nil, fmt.Errorf("getting message %s: %w", c, err)
+		}
+		if msg.Method != power.Methods.CreateMiner {
+			continue
+		}
+
+		lookup, err := api.StateSearchMsg(ctx, types.EmptyTSK, c, lotusapi.LookbackNoLimit, true)
+		if err != nil {
+			return nil, fmt.Errorf("searching for message %s: %w", c, err)
+		}
+		if lookup == nil || lookup.Receipt.ExitCode != 0 {
+			continue
+		}
+
+		var ret power2.CreateMinerReturn
+		if err := ret.UnmarshalCBOR(bytes.NewReader(lookup.Receipt.Return)); err != nil {
+			return nil, fmt.Errorf("decoding CreateMiner return of %s: %w", c, err)
+		}
+
+		// the miner may have been sold or transferred since
+		mi, err := api.StateMinerInfo(ctx, ret.IDAddress, types.EmptyTSK)
+		if err != nil {
+			return nil, fmt.Errorf("getting miner info of %s: %w", ret.IDAddress, err)
+		}
+		if mi.Owner != ownerID {
+			log.Infof("%s is no longer owned by %s; skipping", ret.IDAddress, owner)
+			continue
+		}
+		created = append(created, ret.IDAddress)
+	}
+
+	return created, nil
+}
+
+// ImportMiner records a miner that already exists on chain in the inventory.
+// Miners that are already recorded keep their status and the worker they are
+// keyed by.
+func ImportMiner(ctx context.Context, api lotusapi.FullNode, clock *EpochClock, inv *Inventory, maddr address.Address, status MinerStatus) error {
+	info, err := GetChainMinerInfo(ctx, api, maddr)
+	if err != nil {
+		return err
+	}
+
+	cd, err := api.StateMinerProvingDeadline(ctx, maddr, types.EmptyTSK)
+	if err != nil {
+		return fmt.Errorf("getting proving deadline: %w", err)
+	}
+	hour := GetZerothDeadlineFromCurrentDeadline(clock, cd).Hour()
+
+	return inv.Update(func(recs map[string]*MinerRecord) error {
+		rec := findRecord(recs, maddr.String())
+		if rec == nil {
+			rec = findRecord(recs, info.Worker)
+			if rec != nil && rec.Miner != "" {
+				return fmt.Errorf("worker %s is already recorded for miner %s", info.Worker, rec.Miner)
+			}
+		}
+		if rec == nil {
+			rec = &MinerRecord{Worker: info.Worker, Status: status}
+			recs[info.Worker] = rec
+		}
+
+		if sameAddress(ctx, api, rec.Worker, info.Worker) {
+			rec.CurrentWorker = ""
+		} else {
+			rec.CurrentWorker = info.Worker
+		}
+		rec.Miner = maddr.String()
+		rec.Owner = info.Owner
+		rec.PendingOwner = info.PendingOwner
+		rec.Controls = info.Controls
+		rec.DeadlineHour = &hour
+		rec.Updated = time.Now()
+		return nil
+	})
+}
+
+var importCmd = &cli.Command{
+	Name:  "import",
+	Usage: "record miners that already exist on chain in the inventory",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:     "owner",
+			Usage:    "import the miners owned by this address",
+			Required: true,
+		},
+		&cli.Int64Flag{
+			Name:  "since",
+			Usage: "find miners through the owner's CreateMiner messages since this epoch instead of scanning every miner",
+			Value: -1,
+		},
+		&cli.StringFlag{
+			Name:  "status",
+			Usage: "status to give newly imported miners",
+			Value: string(StatusCreated),
+		},
+	},
+	Action: func(c *cli.Context) error {
+		ctx := context.Background()
+
+		status, err := ParseMinerStatus(c.String("status"))
+		if err != nil {
+			return err
+		}
+
+		owner, err := address.NewFromString(c.String("owner"))
+		if err != nil {
+			return fmt.Errorf("invalid owner address: %w", err)
+		}
+
+		threshold := os.Getenv("THRESHOLD")
+		svc := NewService(ctx, threshold)
+		defer svc.closer()
+
+		var miners []address.Address
+		if c.Int64("since") >= 0 {
+			miners, err = FindMinersCreatedBy(ctx, svc.api, owner, abi.ChainEpoch(c.Int64("since")))
+		} else {
+			miners, err = FindMinersByOwner(ctx, svc.api, owner)
+		}
+		if err != nil {
+			return err
+		}
+
+		inv, err := OpenInventory()
+		if err != nil {
+			return err
+		}
+
+		var imported int
+		for _, maddr := range miners {
+			if err := ImportMiner(ctx, svc.api, svc.clock, inv, maddr, status); err != nil {
+				log.Errorf("importing %s failed: %s", maddr, err)
+				continue
+			}
+			fmt.Println(maddr)
+			imported++
+		}
+
+		fmt.Printf("imported %d of %d miners\n", imported, len(miners))
+		return nil
+	},
+}
@@ -5,18 +5,19 @@ import (
 	"context"
 	"crypto/rand"
 	"fmt"
+	"os"
 
 	"github.com/docker/go-units"
 	"github.com/filecoin-project/go-address"
 	"github.com/filecoin-project/go-state-types/abi"
 	"github.com/filecoin-project/go-state-types/big"
 	lotusapi "github.com/filecoin-project/lotus/api"
-	"github.com/filecoin-project/lotus/build"
 	"github.com/filecoin-project/lotus/chain/actors"
 	"github.com/filecoin-project/lotus/chain/actors/builtin/miner"
 	"github.com/filecoin-project/lotus/chain/actors/builtin/power"
 	"github.com/filecoin-project/lotus/chain/types"
 	power2 "github.com/filecoin-project/specs-actors/v2/actors/builtin/power"
+	"github.com/ipfs/go-cid"
 	crypto "github.com/libp2p/go-libp2p-core/crypto"
 	peer "github.com/libp2p/go-libp2p-core/peer"
 	"github.com/urfave/cli/v2"
@@ -25,8 +26,15 @@ import (
 
 var initCmd = &cli.Command{
 	Name: "init",
-	Action: func(_ *cli.Context) error {
+	Flags: []cli.Flag{
+		maxFeeFlag,
+	},
+	Action: func(c *cli.Context) error {
 		ctx := context.Background()
+
+		if err := setMaxFee(c); err != nil {
+			return err
+		}
 		api, closer, err := LotusClient(ctx)
 		if err != nil {
 			return err
@@ -44,6 +52,8 @@ var initCmd = &cli.Command{
 	},
 }
 
+// Init creates a miner owned by the node's default wallet with a freshly
+// generated worker address and peer ID.
 func Init(ctx context.Context, api lotusapi.FullNode) (address.Address, error) {
 	p2pSk, _, err := crypto.GenerateEd25519Key(rand.Reader)
 	if err != nil {
@@ -60,49 +70,79 @@ func Init(ctx context.Context, api lotusapi.FullNode) (address.Address, error) {
 		return address.Undef, fmt.Errorf("failed to get default wallet: %w", err)
 	}
 
-	ssize, err := units.RAMInBytes("32GiB")
+	worker, err := api.WalletNew(ctx, types.KTBLS)
 	if err != nil {
-		return address.Undef, fmt.Errorf("failed to parse sector size: %w", err)
+		return address.Address{}, fmt.Errorf("failed to create worker wallet address: %w", err)
 	}
 
-	worker, err := api.WalletNew(ctx, types.KTBLS)
+	return CreateMiner(ctx, api, owner, worker, peerid)
+}
+
+// CreateMiner pushes a CreateMiner message to the power actor and waits for
+// it to land, returning the ID address of the new miner.
+func CreateMiner(ctx context.Context, api lotusapi.FullNode, owner, worker address.Address, peerid peer.ID) (address.Address, error) {
+	c, err := PushCreateMiner(ctx, api, owner, worker, peerid)
 	if err != nil {
-		return address.Address{}, fmt.Errorf("failed to create worker wallet address: %w", err)
+		return address.Undef, err
 	}
 
+	return WaitCreateMiner(ctx, api, c)
+}
+
+// PushCreateMiner pushes a CreateMiner message to the power actor without
+// waiting for it. If the worker account does not exist on chain yet, a message
+// creating it is pushed first; the mpool orders the two by nonce, so the
+// account exists by the time the miner is created.
+func PushCreateMiner(ctx context.Context, api lotusapi.FullNode, owner, worker address.Address, peerid peer.ID) (cid.Cid, error) {
 	// make sure the worker account exists on chain
-	_, err = api.StateLookupID(ctx, worker, types.EmptyTSK)
+	_, err := api.StateLookupID(ctx, worker, types.EmptyTSK)
 	if err != nil {
-		signed, err := api.MpoolPushMessage(ctx, &types.Message{
+		signed, err := PushMessage(ctx, api, &types.Message{
 			From:  owner,
 			To:    worker,
 			Value: types.NewInt(0),
-		}, nil)
+		})
 		if err != nil {
-			return address.Undef, xerrors.Errorf("push worker init: %w", err)
+			return cid.Undef, xerrors.Errorf("push worker init: %w", err)
 		}
 
 		log.Infof("Initializing worker account %s, message: %s", worker, signed.Cid())
-		log.Infof("Waiting for confirmation")
+	}
 
-		mw, err := api.StateWaitMsg(ctx, signed.Cid(), build.MessageConfidence, lotusapi.LookbackNoLimit, true)
-		// mw, err := api.StateWaitMsg(ctx, signed.Cid(), build.MessageConfidence)
-		if err != nil {
-			return address.Undef, xerrors.Errorf("waiting for worker init: %w", err)
-		}
-		if mw.Receipt.ExitCode != 0 {
-			return address.Undef, xerrors.Errorf("initializing worker account failed: exit code %d", mw.Receipt.ExitCode)
-		}
+	createStorageMinerMsg, err := CreateMinerMessage(ctx, api, owner, worker, peerid)
+	if err != nil {
+		return cid.Undef, err
+	}
+
+	signed, err := PushMessage(ctx, api, createStorageMinerMsg)
+	if err != nil {
+		return cid.Undef, xerrors.Errorf("pushing createMiner message: %w", err)
+	}
+
+	log.Infof("Pushed CreateMiner message: %s", signed.Cid())
+	return signed.Cid(), nil
+}
+
+// CreateMinerMessage builds an unsigned CreateMiner message for a miner with
+// SECTOR_SIZE sectors, 32GiB by default.
+func CreateMinerMessage(ctx context.Context, api lotusapi.FullNode, owner, worker address.Address, peerid peer.ID) (*types.Message, error) {
+	sectorSize := os.Getenv("SECTOR_SIZE")
+	if sectorSize == "" {
+		sectorSize = "32GiB"
+	}
+	ssize, err := units.RAMInBytes(sectorSize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse sector size: %w", err)
 	}
 
 	nv, err := api.StateNetworkVersion(ctx, types.EmptyTSK)
 	if err != nil {
-		return address.Undef, xerrors.Errorf("getting network version: %w", err)
+		return nil, xerrors.Errorf("getting network version: %w", err)
 	}
 
 	spt, err := miner.SealProofTypeFromSectorSize(abi.SectorSize(ssize), nv)
 	if err != nil {
-		return address.Undef, xerrors.Errorf("getting seal proof type: %w", err)
+		return nil, xerrors.Errorf("getting seal proof type: %w", err)
 	}
 
 	params, err := actors.SerializeParams(&power2.CreateMinerParams{
@@ -112,12 +152,12 @@ func Init(ctx context.Context, api lotusapi.FullNode) (address.Address, error) {
 		Peer:          abi.PeerID(peerid),
 	})
 	if err != nil {
-		return address.Undef, xerrors.Errorf("failed to serialize params: %w", err)
+		return nil, xerrors.Errorf("failed to serialize params: %w", err)
 	}
 
 	sender := owner
 
-	createStorageMinerMsg := &types.Message{
+	return &types.Message{
 		To:    power.Address,
 		From:  sender,
 		Value: big.Zero(),
@@ -127,24 +167,25 @@ func Init(ctx context.Context, api lotusapi.FullNode) (address.Address, error) {
 
 		GasLimit:   0,
 		GasPremium: types.NewInt(0),
-	}
+	}, nil
+}
 
-	signed, err := api.MpoolPushMessage(ctx, createStorageMinerMsg, nil)
-	if err != nil {
-		return address.Undef, xerrors.Errorf("pushing createMiner message: %w", err)
-	}
+// errCreateMinerFailed is returned for a CreateMiner message that landed but
+// did not create a miner
+var errCreateMinerFailed = xerrors.New("create miner failed")
 
-	log.Infof("Pushed CreateMiner message: %s", signed.Cid())
-	log.Infof("Waiting for confirmation")
+// WaitCreateMiner waits for a CreateMiner message to land and returns the ID
+// address of the new miner.
+func WaitCreateMiner(ctx context.Context, api lotusapi.FullNode, c cid.Cid) (address.Address, error) {
+	log.Infof("Waiting for confirmation of %s", c)
 
-	mw, err := api.StateWaitMsg(ctx, signed.Cid(), build.MessageConfidence, lotusapi.LookbackNoLimit, true)
-	// mw, err := api.StateWaitMsg(ctx, signed.Cid(), build.MessageConfidence)
+	mw, err := WaitMessage(ctx, api, c)
 	if err != nil {
 		return address.Undef, xerrors.Errorf("waiting for createMiner message: %w", err)
 	}
 
 	if mw.Receipt.ExitCode != 0 {
-		return address.Undef, xerrors.Errorf("create miner failed: exit code %d", mw.Receipt.ExitCode)
+		return address.Undef, xerrors.Errorf("%w: exit code %d", errCreateMinerFailed, mw.Receipt.ExitCode)
 	}
 
 	var retval power2.CreateMinerReturn
@@ -155,3 +196,21 @@ func Init(ctx context.Context, api lotusapi.FullNode) (address.Address, error) {
 	log.Infof("New miners address is: %s (%s)", retval.IDAddress, retval.RobustAddress)
 	return retval.IDAddress, nil
 }
+
+// CreateMinerReceipt looks up the receipt of a CreateMiner message that has
+// landed
+func CreateMinerReceipt(ctx context.Context, api lotusapi.FullNode, c cid.Cid) (*CreateReceipt, error) {
+	lookup, err := api.StateSearchMsg(ctx, types.EmptyTSK, c, lotusapi.LookbackNoLimit, true)
+	if err != nil {
+		return nil, xerrors.Errorf("searching for message: %w", err)
+	}
+	if lookup == nil {
+		return nil, xerrors.Errorf("message %s not found on chain", c)
+	}
+
+	return &CreateReceipt{
+		ExitCode: int64(lookup.Receipt.ExitCode),
+		Return:   lookup.Receipt.Return,
+		GasUsed:  lookup.Receipt.GasUsed,
+	}, nil
+}
@@ -0,0 +1,459 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/mitchellh/go-homedir"
+	"github.com/urfave/cli/v2"
+)
+
+// MinerStatus is where a miner is in its lifecycle
+type MinerStatus string
+
+const (
+	StatusCreated     MinerStatus = "created"
+	StatusBackedUp    MinerStatus = "backed-up"
+	StatusKeep        MinerStatus = "keep"
+	StatusForSale     MinerStatus = "for-sale"
+	StatusReserved    MinerStatus = "reserved"
+	StatusSold        MinerStatus = "sold"
+	StatusTransferred MinerStatus = "transferred"
+)
+
+var minerStatuses = []MinerStatus{
+	StatusCreated,
+	StatusBackedUp,
+	StatusKeep,
+	StatusForSale,
+	StatusReserved,
+	StatusSold,
+	StatusTransferred,
+}
+
+// ParseMinerStatus parses a lifecycle status name
+func ParseMinerStatus(s string) (MinerStatus, error) {
+	for _, st := range minerStatuses {
+		if string(st) == s {
+			return st, nil
+		}
+	}
+	return "", fmt.Errorf("unknown status %q", s)
+}
+
+// MinerRecord is everything we know about a miner we bought
+type MinerRecord struct {
+	// Worker is the worker the miner was bought with. It keys the record,
+	// the miner's repo and its backups, so it stays when the worker changes
+	// on chain; CurrentWorker records the new one.
+	Worker        string
+	CurrentWorker string         `json:",omitempty"`
+	Miner         string         `json:",omitempty"`
+	Owner         string         `json:",omitempty"`
+	PendingOwner  string         `json:",omitempty"`
+	Controls      []string       `json:",omitempty"`
+	CreatedEpoch  abi.ChainEpoch `json:",omitempty"`
+	Message       string         `json:",omitempty"`
+	Receipt       *CreateReceipt `json:",omitempty"`
+	DeadlineHour  *int           `json:",omitempty"`
+	Cost          abi.TokenAmount
+	Remotes       []RemoteBackup `json:",omitempty"`
+	Status        MinerStatus
+	Updated       time.Time
+}
+
+// Inventory stores a record for every miner, keyed by worker address, in a
+// single JSON file. Every access holds a lock on the file so concurrent runs
+// don't overwrite each other's changes.
+type Inventory struct {
+	path string
+}
+
+// OpenInventory opens the inventory in ~/.fil-miner-buyer/inventory.json
+func OpenInventory() (*Inventory, error) {
+	h, err := homedir.Dir()
+	if err != nil {
+		return nil, fmt.Errorf("getting home directory failed: %w", err)
+	}
+
+	if err := os.MkdirAll(home(h, ".fil-miner-buyer"), 0755); err != nil {
+		return nil, err
+	}
+
+	return &Inventory{path: home(h, ".fil-miner-buyer/inventory.json")}, nil
+}
+
+// lock takes a lock on the inventory that is released by calling the
+// returned function
+func (inv *Inventory) lock(how int) (func(), error) {
+	f, err := os.OpenFile(inv.path+".lock", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("opening inventory lock: %w", err)
+	}
+
+	if err := syscall.Flock(int(f.Fd()), how); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("locking inventory: %w", err)
+	}
+
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
+
+func (inv *Inventory) load() (map[string]*MinerRecord, error) {
+	recs := map[string]*MinerRecord{}
+
+	content, err := ioutil.ReadFile(inv.path)
+	if os.IsNotExist(err) {
+		return recs, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(content, &recs); err != nil {
+		return nil, fmt.Errorf("decoding inventory: %w", err)
+	}
+	return recs, nil
+}
+
+func (inv *Inventory) save(recs map[string]*MinerRecord) error {
+	b, err := json.MarshalIndent(recs, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// write to a temporary file first so a crash never leaves a torn inventory
+	tmp := inv.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, inv.path)
+}
+
+// Update loads the inventory, lets fn change it and saves the result, all
+// while holding an exclusive lock.
+func (inv *Inventory) Update(fn func(recs map[string]*MinerRecord) error) error {
+	unlock, err := inv.lock(syscall.LOCK_EX)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	recs, err := inv.load()
+	if err != nil {
+		return err
+	}
+
+	if err := fn(recs); err != nil {
+		return err
+	}
+
+	return inv.save(recs)
+}
+
+// List returns every record ordered by worker address
+func (inv *Inventory) List() ([]*MinerRecord, error) {
+	unlock, err := inv.lock(syscall.LOCK_SH)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	recs, err := inv.load()
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]*MinerRecord, 0, len(recs))
+	for _, rec := range recs {
+		list = append(list, rec)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Worker < list[j].Worker
+	})
+	return list, nil
+}
+
+// Get returns the record for a worker address or miner ID
+func (inv *Inventory) Get(key string) (*MinerRecord, error) {
+	list, err := inv.List()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, rec := range list {
+		if rec.matches(key) {
+			return rec, nil
+		}
+	}
+	return nil, fmt.Errorf("no miner %s in inventory", key)
+}
+
+// matches reports whether key is the record's worker, current worker or miner
+func (rec *MinerRecord) matches(key string) bool {
+	return rec.Worker == key || rec.Miner == key || rec.CurrentWorker == key
+}
+
+// findRecord returns the record in recs for a worker address or miner ID, or
+// nil if there is none
+func findRecord(recs map[string]*MinerRecord, key string) *MinerRecord {
+	if rec, ok := recs[key]; ok {
+		return rec
+	}
+	for _, rec := range recs {
+		if rec.matches(key) {
+			return rec
+		}
+	}
+	return nil
+}
+
+// resolveWorker returns the worker of a miner given by its ID through the
+// inventory, and any other address as is
+func resolveWorker(s string) (string, error) {
+	addr, err := address.NewFromString(s)
+	if err != nil || addr.Protocol() != address.ID {
+		return s, nil
+	}
+
+	inv, err := OpenInventory()
+	if err != nil {
+		return "", err
+	}
+	rec, err := inv.Get(s)
+	if err != nil {
+		return "", err
+	}
+	return rec.Worker, nil
+}
+
+// Set creates or changes the record of a worker
+func (inv *Inventory) Set(worker string, fn func(rec *MinerRecord)) error {
+	return inv.Update(func(recs map[string]*MinerRecord) error {
+		rec, ok := recs[worker]
+		if !ok {
+			rec = &MinerRecord{Worker: worker, Status: StatusCreated}
+			recs[worker] = rec
+		}
+
+		fn(rec)
+		rec.Updated = time.Now()
+		return nil
+	})
+}
+
+// SetStatus changes the status of the miner with the given worker address or
+// miner ID
+func (inv *Inventory) SetStatus(key string, status MinerStatus) error {
+	return inv.Update(func(recs map[string]*MinerRecord) error {
+		rec := findRecord(recs, key)
+		if rec == nil {
+			return fmt.Errorf("no miner %s in inventory", key)
+		}
+		rec.Status = status
+		rec.Updated = time.Now()
+		return nil
+	})
+}
+
+// ImportLists adds the workers from the keepminer, sellminer and backupminer
+// lists in dir to the inventory. Workers already in the inventory are left
+// alone.
+func (inv *Inventory) ImportLists(dir string) (int, error) {
+	lists := []struct {
+		file   string
+		status MinerStatus
+	}{
+		{"keepminer.list", StatusKeep},
+		{"sellminer.list", StatusForSale},
+		{"backupminer.list", StatusBackedUp},
+	}
+
+	var imported int
+	err := inv.Update(func(recs map[string]*MinerRecord) error {
+		for _, l := range lists {
+			f, err := os.Open(home(dir, l.file))
+			if os.IsNotExist(err) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+
+			sc := bufio.NewScanner(f)
+			for sc.Scan() {
+				worker := strings.TrimSpace(sc.Text())
+				if worker == "" {
+					continue
+				}
+				if _, ok := recs[worker]; ok {
+					continue
+				}
+
+				recs[worker] = &MinerRecord{
+					Worker:  worker,
+					Status:  l.status,
+					Updated: time.Now(),
+				}
+				imported++
+			}
+			err = sc.Err()
+			f.Close()
+			if err != nil {
+				return fmt.Errorf("reading %s: %w", l.file, err)
+			}
+		}
+		return nil
+	})
+
+	return imported, err
+}
+
+func printMinerRecords(recs []*MinerRecord) error {
+	tw := tabwriter.NewWriter(os.Stdout, 2, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "WORKER\tMINER\tOWNER\tEPOCH\tDL0 HOUR\tSTATUS")
+	for _, rec := range recs {
+		hour := "-"
+		if rec.DeadlineHour != nil {
+			hour = fmt.Sprint(*rec.DeadlineHour)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\t%s\n", rec.Worker, rec.Miner, rec.Owner, rec.CreatedEpoch, hour, rec.Status)
+	}
+	return tw.Flush()
+}
+
+var inventoryCmd = &cli.Command{
+	Name:  "inventory",
+	Usage: "manage the inventory of bought miners",
+	Subcommands: []*cli.Command{
+		inventoryListCmd,
+		inventoryShowCmd,
+		inventorySetStatusCmd,
+		inventoryImportListsCmd,
+	},
+}
+
+var inventoryListCmd = &cli.Command{
+	Name:  "list",
+	Usage: "list miners in the inventory",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "status",
+			Usage: "only list miners with this status",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		inv, err := OpenInventory()
+		if err != nil {
+			return err
+		}
+
+		recs, err := inv.List()
+		if err != nil {
+			return err
+		}
+
+		if c.IsSet("status") {
+			status, err := ParseMinerStatus(c.String("status"))
+			if err != nil {
+				return err
+			}
+
+			var filtered []*MinerRecord
+			for _, rec := range recs {
+				if rec.Status == status {
+					filtered = append(filtered, rec)
+				}
+			}
+			recs = filtered
+		}
+
+		return printMinerRecords(recs)
+	},
+}
+
+var inventoryShowCmd = &cli.Command{
+	Name:  "show",
+	Usage: "show <worker|minerID>",
+	Action: func(c *cli.Context) error {
+		if c.Args().Len() < 1 {
+			return fmt.Errorf("please provide a worker address or miner ID")
+		}
+
+		inv, err := OpenInventory()
+		if err != nil {
+			return err
+		}
+
+		rec, err := inv.Get(c.Args().First())
+		if err != nil {
+			return err
+		}
+
+		b, err := json.MarshalIndent(rec, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(b))
+		return nil
+	},
+}
+
+var inventorySetStatusCmd = &cli.Command{
+	Name:  "set-status",
+	Usage: "set-status <worker|minerID> <created|backed-up|keep|for-sale|reserved|sold|transferred>",
+	Action: func(c *cli.Context) error {
+		if c.Args().Len() < 2 {
+			return fmt.Errorf("please provide a worker address or miner ID and a status")
+		}
+
+		status, err := ParseMinerStatus(c.Args().Get(1))
+		if err != nil {
+			return err
+		}
+
+		inv, err := OpenInventory()
+		if err != nil {
+			return err
+		}
+
+		return inv.SetStatus(c.Args().First(), status)
+	},
+}
+
+var inventoryImportListsCmd = &cli.Command{
+	Name:  "import-lists",
+	Usage: "import keepminer.list, sellminer.list and backupminer.list from the home directory",
+	Action: func(c *cli.Context) error {
+		h, err := homedir.Dir()
+		if err != nil {
+			return fmt.Errorf("getting home directory failed: %w", err)
+		}
+
+		inv, err := OpenInventory()
+		if err != nil {
+			return err
+		}
+
+		n, err := inv.ImportLists(h)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("imported %d miners\n", n)
+		return nil
+	},
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	lotusapi "github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/chain/actors/builtin/power"
+	"github.com/filecoin-project/lotus/chain/types"
+	power2 "github.com/filecoin-project/specs-actors/v2/actors/builtin/power"
+	"github.com/ipfs/go-cid"
+	crypto "github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/mitchellh/go-homedir"
+)
+
+// purchaseStep is the last step a purchase completed
+type purchaseStep int
+
+const (
+	stepNone purchaseStep = iota
+	stepWalletCreated
+	stepMessagePushed
+	stepMinerCreated
+	stepRepoInitialised
+	stepBackedUp
+	stepClassified
+	// stepAbandoned ends a purchase that never created a miner, because its
+	// CreateMiner message failed or was never pushed
+	stepAbandoned
+)
+
+var stepNames = []string{
+	"none",
+	"wallet-created",
+	"message-pushed",
+	"miner-created",
+	"repo-initialised",
+	"backed-up",
+	"classified",
+	"abandoned",
+}
+
+func (st purchaseStep) String() string {
+	if int(st) < len(stepNames) {
+		return stepNames[st]
+	}
+	return fmt.Sprintf("step(%d)", int(st))
+}
+
+func (st purchaseStep) MarshalText() ([]byte, error) {
+	return []byte(st.String()), nil
+}
+
+func (st *purchaseStep) UnmarshalText(b []byte) error {
+	for i, name := range stepNames {
+		if name == string(b) {
+			*st = purchaseStep(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown purchase step %q", b)
+}
+
+// JournalEntry records a purchase completing a step. Entries are only ever
+// appended, the latest entry for a worker is the state of its purchase.
+type JournalEntry struct {
+	Time    time.Time
+	Step    purchaseStep
+	Worker  string
+	PeerKey []byte `json:",omitempty"`
+	Message string `json:",omitempty"`
+	Miner   string `json:",omitempty"`
+}
+
+// journalMu serialises appends from concurrently waiting purchases
+var journalMu sync.Mutex
+
+func journalFile() (string, error) {
+	h, err := homedir.Dir()
+	if err != nil {
+		return "", fmt.Errorf("getting home directory failed: %w", err)
+	}
+
+	if err := os.MkdirAll(home(h, ".fil-miner-buyer"), 0755); err != nil {
+		return "", err
+	}
+	return home(h, ".fil-miner-buyer/journal.jsonl"), nil
+}
+
+// journal records that p completed step
+func (p *purchase) journal(step purchaseStep) error {
+	p.step = step
+
+	e := JournalEntry{
+		Time:   time.Now(),
+		Step:   step,
+		Worker: p.worker.String(),
+	}
+	if step == stepWalletCreated {
+		// the peer key is needed to build the repo when resuming
+		kb, err := crypto.MarshalPrivateKey(p.p2pSk)
+		if err != nil {
+			return err
+		}
+		e.PeerKey = kb
+	}
+	if p.msg.Defined() {
+		e.Message = p.msg.String()
+	}
+	if p.maddr != address.Undef {
+		e.Miner = p.maddr.String()
+	}
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	file, err := journalFile()
+	if err != nil {
+		return err
+	}
+
+	journalMu.Lock()
+	defer journalMu.Unlock()
+
+	// the journal holds peer keys, so keep it private
+	f, err := os.OpenFile(file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("opening purchase journal: %w", err)
+	}
+	defer f.Close()
+
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		return fmt.Errorf("writing purchase journal: %w", err)
+	}
+	return f.Sync()
+}
+
+// unfinishedPurchases rebuilds every purchase from the journal that was
+// neither classified nor abandoned.
+func unfinishedPurchases() ([]*purchase, error) {
+	file, err := journalFile()
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var order []string
+	byWorker := map[string]*purchase{}
+	for _, line := range strings.Split(string(content), "\n") {
+		if line == "" {
+			continue
+		}
+
+		var e JournalEntry
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			// a crash may have left the last line half written
+			log.Infof("skipping unreadable journal entry: %s", err)
+			continue
+		}
+
+		p, ok := byWorker[e.Worker]
+		if !ok {
+			p = &purchase{}
+			byWorker[e.Worker] = p
+			order = append(order, e.Worker)
+
+			p.worker, err = address.NewFromString(e.Worker)
+			if err != nil {
+				return nil, fmt.Errorf("journal entry has invalid worker: %w", err)
+			}
+		}
+
+		p.step = e.Step
+		if e.Step == stepWalletCreated {
+			p.started = e.Time
+		}
+		if len(e.PeerKey) > 0 {
+			p.p2pSk, err = crypto.UnmarshalPrivateKey(e.PeerKey)
+			if err != nil {
+				return nil, fmt.Errorf("journal entry for %s has invalid peer key: %w", e.Worker, err)
+			}
+		}
+		if e.Message != "" {
+			p.msg, err = cid.Decode(e.Message)
+			if err != nil {
+				return nil, fmt.Errorf("journal entry for %s has invalid message: %w", e.Worker, err)
+			}
+		}
+		if e.Miner != "" {
+			p.maddr, err = address.NewFromString(e.Miner)
+			if err != nil {
+				return nil, fmt.Errorf("journal entry for %s has invalid miner: %w", e.Worker, err)
+			}
+		}
+	}
+
+	var ps []*purchase
+	for _, w := range order {
+		if p := byWorker[w]; p.step < stepClassified {
+			ps = append(ps, p)
+		}
+	}
+	return ps, nil
+}
+
+// findCreateMiner looks for a CreateMiner message from the owner for the
+// worker, pending or on chain since the purchase started. A crash between
+// pushing the message and journaling it leaves only the chain to tell.
+func (s *Service) findCreateMiner(ctx context.Context, owner address.Address, p *purchase) (cid.Cid, error) {
+	isFor := func(msg *types.Message) bool {
+		if msg.From != owner || msg.To != power.Address || msg.Method != power.Methods.CreateMiner {
+			return false
+		}
+		var params power2.CreateMinerParams
+		if err := params.UnmarshalCBOR(bytes.NewReader(msg.Params)); err != nil {
+			return false
+		}
+		return params.Worker == p.worker
+	}
+
+	pending, err := s.api.MpoolPending(ctx, types.EmptyTSK)
+	if err != nil {
+		return cid.Undef, fmt.Errorf("getting pending messages: %w", err)
+	}
+	for _, sm := range pending {
+		if isFor(&sm.Message) {
+			return sm.Cid(), nil
+		}
+	}
+
+	// look back a little further in case the clocks disagree
+	since := s.clock.Epoch(p.started) - 10
+	if p.started.IsZero() || since < 0 {
+		since = 0
+	}
+	cids, err := s.api.StateListMessages(ctx, &lotusapi.MessageMatch{From: owner, To: power.Address}, types.EmptyTSK, since)
+	if err != nil {
+		return cid.Undef, fmt.Errorf("listing messages of %s: %w", owner, err)
+	}
+	for _, c := range cids {
+		msg, err := s.api.ChainGetMessage(ctx, c)
+		if err != nil {
+			return cid.Undef, fmt.Errorf("getting message %s: %w", c, err)
+		}
+		if isFor(msg) {
+			return c, nil
+		}
+	}
+	return cid.Undef, nil
+}
+
+// waitMiner waits for the CreateMiner message of p and journals the miner it
+// created, or abandons the purchase if the message failed
+func (s *Service) waitMiner(ctx context.Context, p *purchase) {
+	p.maddr, p.err = WaitCreateMiner(ctx, s.api, p.msg)
+	switch {
+	case p.err == nil:
+		p.err = p.journal(stepMinerCreated)
+	case errors.Is(p.err, errCreateMinerFailed):
+		if err := p.journal(stepAbandoned); err != nil {
+			log.Errorf("journaling failed purchase of %s: %s", p.worker, err)
+		}
+	}
+}
+
+// abandonUnpushed abandons a purchase whose CreateMiner message failed to be
+// pushed, unless the node took it after all
+func (s *Service) abandonUnpushed(ctx context.Context, owner address.Address, p *purchase) {
+	if p.step != stepWalletCreated {
+		return
+	}
+	c, err := s.findCreateMiner(ctx, owner, p)
+	if err != nil || c.Defined() {
+		// leave it for --resume to sort out
+		return
+	}
+	if err := p.journal(stepAbandoned); err != nil {
+		log.Errorf("journaling unpushed purchase of %s: %s", p.worker, err)
+	}
+}
+
+// ResumePurchases completes the remaining steps of every purchase the journal
+// shows as unfinished. Purchases that never pushed a CreateMiner message cost
+// nothing and are skipped.
+func (s *Service) ResumePurchases(ctx context.Context) ([]*purchase, error) {
+	ps, err := unfinishedPurchases()
+	if err != nil {
+		return nil, fmt.Errorf("reading purchase journal: %w", err)
+	}
+
+	owner, err := address.NewFromString(s.owner)
+	if err != nil {
+		return nil, fmt.Errorf("parsing owner address failed: %w", err)
+	}
+
+	var pushed []*purchase
+	for _, p := range ps {
+		if p.step < stepMessagePushed {
+			c, err := s.findCreateMiner(ctx, owner, p)
+			if err != nil {
+				return nil, fmt.Errorf("looking for CreateMiner of worker %s: %w", p.worker, err)
+			}
+			if !c.Defined() {
+				log.Infof("no CreateMiner message was pushed for worker %s; abandoning it", p.worker)
+				if err := p.journal(stepAbandoned); err != nil {
+					return nil, err
+				}
+				continue
+			}
+
+			log.Infof("found unjournaled CreateMiner %s for worker %s", c, p.worker)
+			p.msg = c
+			if err := p.journal(stepMessagePushed); err != nil {
+				return nil, err
+			}
+		}
+		pushed = append(pushed, p)
+	}
+	ps = pushed
+
+	var wg sync.WaitGroup
+	for _, p := range ps {
+		if p.step >= stepMinerCreated {
+			continue
+		}
+
+		wg.Add(1)
+		go func(p *purchase) {
+			defer wg.Done()
+			log.Infof("looking up receipt of %s for worker %s", p.msg, p.worker)
+			s.waitMiner(ctx, p)
+		}(p)
+	}
+	wg.Wait()
+
+	for _, p := range ps {
+		if p.err != nil {
+			continue
+		}
+		log.Infof("resuming purchase of %s after step %s", p.maddr, p.step)
+		p.err = s.finishPurchase(ctx, p)
+	}
+
+	return ps, nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"crypto/rand"
+	"os"
+	"testing"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/ipfs/go-cid"
+	crypto "github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/mitchellh/go-homedir"
+)
+
+func testPurchase(t *testing.T, worker string) *purchase {
+	// any key address will do for the journal
+	addr, err := address.NewSecp256k1Address([]byte(worker))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sk, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &purchase{worker: addr, p2pSk: sk}
+}
+
+func testCid(t *testing.T, s string) cid.Cid {
+	// 0x12 is sha2-256
+	c, err := cid.Prefix{Version: 1, Codec: cid.DagCBOR, MhType: 0x12, MhLength: -1}.Sum([]byte(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestUnfinishedPurchases(t *testing.T) {
+	homedir.DisableCache = true
+	t.Cleanup(func() { homedir.DisableCache = false })
+	setenv(t, "HOME", t.TempDir())
+
+	journal := func(p *purchase, steps ...purchaseStep) {
+		for _, st := range steps {
+			if err := p.journal(st); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	unpushed := testPurchase(t, "unpushed")
+	journal(unpushed, stepWalletCreated)
+
+	waiting := testPurchase(t, "waiting")
+	journal(waiting, stepWalletCreated)
+	waiting.msg = testCid(t, "waiting")
+	journal(waiting, stepMessagePushed)
+
+	created := testPurchase(t, "created")
+	journal(created, stepWalletCreated)
+	created.msg = testCid(t, "created")
+	journal(created, stepMessagePushed)
+	created.maddr, _ = address.NewIDAddress(1000)
+	journal(created, stepMinerCreated, stepRepoInitialised)
+
+	done := testPurchase(t, "done")
+	journal(done, stepWalletCreated, stepMessagePushed, stepMinerCreated, stepRepoInitialised, stepBackedUp, stepClassified)
+
+	abandoned := testPurchase(t, "abandoned")
+	journal(abandoned, stepWalletCreated, stepAbandoned)
+
+	failed := testPurchase(t, "failed")
+	journal(failed, stepWalletCreated)
+	failed.msg = testCid(t, "failed")
+	journal(failed, stepMessagePushed, stepAbandoned)
+
+	// a crash can leave a torn last line
+	file, err := journalFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(file, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"Time":"2021-09-01T00:00:00Z","Step":"mess`)
+	f.Close()
+
+	ps, err := unfinishedPurchases()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []struct {
+		p    *purchase
+		step purchaseStep
+	}{
+		{unpushed, stepWalletCreated},
+		{waiting, stepMessagePushed},
+		{created, stepRepoInitialised},
+	}
+	if len(ps) != len(want) {
+		var got []string
+		for _, p := range ps {
+			got = append(got, p.worker.String()+" "+p.step.String())
+		}
+		t.Fatalf("got %d unfinished purchases %v, want %d", len(ps), got, len(want))
+	}
+
+	for i, w := range want {
+		p := ps[i]
+		if p.worker != w.p.worker || p.step != w.step {
+			t.Errorf("purchase %d is %s at %s, want %s at %s", i, p.worker, p.step, w.p.worker, w.step)
+		}
+		if p.msg != w.p.msg {
+			t.Errorf("purchase of %s has message %s, want %s", p.worker, p.msg, w.p.msg)
+		}
+		if p.maddr != w.p.maddr {
+			t.Errorf("purchase of %s has miner %s, want %s", p.worker, p.maddr, w.p.maddr)
+		}
+		if p.p2pSk == nil || !p.p2pSk.Equals(w.p.p2pSk) {
+			t.Errorf("purchase of %s did not keep its peer key", p.worker)
+		}
+		if p.started.IsZero() {
+			t.Errorf("purchase of %s has no start time", p.worker)
+		}
+	}
+}
+
+func TestPurchaseStepText(t *testing.T) {
+	for st := stepNone; st <= stepAbandoned; st++ {
+		b, err := st.MarshalText()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got purchaseStep
+		if err := got.UnmarshalText(b); err != nil || got != st {
+			t.Errorf("%s does not round trip: got %s, %v", st, got, err)
+		}
+	}
+
+	var st purchaseStep
+	if err := st.UnmarshalText([]byte("bogus")); err == nil {
+		t.Error("UnmarshalText accepted an unknown step")
+	}
+}
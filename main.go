@@ -2,11 +2,16 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"os"
+	"os/signal"
 	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
 	"time"
 
 	"github.com/filecoin-project/go-address"
@@ -16,12 +21,13 @@ import (
 	"github.com/filecoin-project/go-state-types/dline"
 	lotusapi "github.com/filecoin-project/lotus/api"
 	"github.com/filecoin-project/lotus/api/client"
-	"github.com/filecoin-project/lotus/build"
 	"github.com/filecoin-project/lotus/chain/actors"
 	"github.com/filecoin-project/lotus/chain/actors/builtin/miner"
 	"github.com/filecoin-project/lotus/chain/types"
-	"github.com/filecoin-project/specs-actors/actors/builtin"
+	"github.com/ipfs/go-cid"
 	logging "github.com/ipfs/go-log/v2"
+	crypto "github.com/libp2p/go-libp2p-core/crypto"
+	peer "github.com/libp2p/go-libp2p-core/peer"
 	"github.com/mitchellh/go-homedir"
 	"github.com/urfave/cli/v2"
 )
@@ -35,8 +41,38 @@ type Service struct {
 	closer jsonrpc.ClientCloser
 
 	threshold types.FIL
-	start     time.Time
-	finish    time.Time
+
+	// windows are the times of day the zeroth deadline of a miner we keep
+	// must fall in
+	windows Windows
+
+	clock *EpochClock
+
+	// budget is the most a single CreateMiner message may cost; when set it
+	// is used instead of comparing the gas premium against threshold
+	budget types.FIL
+
+	// predict skips purchases whose predicted zeroth deadline falls outside
+	// of the trading window
+	predict bool
+
+	// estWorker is an existing BLS account used to estimate CreateMiner gas
+	estWorker address.Address
+
+	// when percentile is set, gas has to be below that percentile of the
+	// prices recorded in gasHistory over the last historyWindow
+	gasHistory    *GasHistory
+	percentile    float64
+	historyWindow time.Duration
+
+	// minerExited receives the exit of the lotus-miner started by
+	// StartMiner, once it is reaped
+	minerExited <-chan error
+
+	// minerAPI and minerToken reach the lotus-miner started by StartMiner
+	// once its API answers
+	minerAPI   string
+	minerToken string
 
 	Miner
 }
@@ -72,12 +108,25 @@ func (s Miner) MinerPath() string {
 	return home(s.h, fmt.Sprintf("%s%s", prefix, s.worker))
 }
 
+// BackupRoot is where backups are kept, LOTUS_BACKUP_DIR or ~/.lotusbackup
+func (s Miner) BackupRoot() string {
+	if root := os.Getenv("LOTUS_BACKUP_DIR"); root != "" {
+		return root
+	}
+	return home(s.h, ".lotusbackup")
+}
+
+// BackupDir is where the backups of the worker's miner are kept
+func (s Miner) BackupDir() string {
+	return home(s.BackupRoot(), s.worker)
+}
+
 func (s Miner) MinerPathEnv() string {
 	minerpath := s.MinerPath()
 	return fmt.Sprintf("LOTUS_MINER_PATH=%s", minerpath)
 }
 
-func NewService(ctx context.Context, threshold string, times ...string) *Service {
+func NewService(ctx context.Context, threshold string) *Service {
 	api, closer, err := LotusClient(ctx)
 	if err != nil {
 		log.Fatalf("connecting with lotus failed: %s", err)
@@ -90,14 +139,12 @@ func NewService(ctx context.Context, threshold string, times ...string) *Service
 		log.Fatalf("parsing threshold failed: %s", err)
 	}
 
-	var start, finish time.Time
-	if len(times) == 0 {
-		start, _ = time.Parse(time.Kitchen, "9:00AM")
-		finish, _ = time.Parse(time.Kitchen, "5:00PM")
-	} else {
-		fmt.Println("times:", times)
-		start, _ = time.Parse(time.Kitchen, times[0])
-		finish, _ = time.Parse(time.Kitchen, times[1])
+	var budgetFIL types.FIL
+	if budget := os.Getenv("BUDGET"); budget != "" {
+		budgetFIL, err = types.ParseFIL(budget)
+		if err != nil {
+			log.Fatalf("parsing budget failed: %s", err)
+		}
 	}
 
 	h, err := homedir.Dir()
@@ -105,19 +152,31 @@ func NewService(ctx context.Context, threshold string, times ...string) *Service
 		log.Infof("getting home directory failed: %s", err)
 	}
 
+	clock, err := NewEpochClock(ctx, api)
+	if err != nil {
+		log.Fatalf("setting up epoch clock failed: %s", err)
+	}
+
 	miner := Miner{owner, "", "", h}
 
-	return &Service{api: api, closer: closer, threshold: thresholdFIL, start: start, finish: finish, Miner: miner}
+	return &Service{api: api, closer: closer, threshold: thresholdFIL, budget: budgetFIL, clock: clock, Miner: miner}
 }
 
 func main() {
 	local := []*cli.Command{
 		buyCmd,
 		infoCmd,
+		gasCmd,
 		fixCmd,
 		backupCmd,
+		restoreCmd,
 		getCmd,
 		transferCmd,
+		replacementsCmd,
+		inventoryCmd,
+		reconcileCmd,
+		importCmd,
+		scheduleCmd,
 		initCmd,
 	}
 
@@ -130,10 +189,30 @@ func main() {
 				Usage: "enable debug mode",
 				Value: false,
 			},
+			maxFeeFlag,
+			stuckEpochsFlag,
+			configFlag,
+			profileFlag,
+			backupRecipientFlag,
+			backupIdentityFlag,
+			backupAllowPlaintextFlag,
+			backupAllowUnverifiedFlag,
+			backupTargetFlag,
 		},
 		Before: func(ctx *cli.Context) error {
 			debug = ctx.Bool("debug")
-			return nil
+			if err := applyProfile(ctx); err != nil {
+				return err
+			}
+			stuckEpochs = ctx.Int("stuck-epochs")
+			backupRecipients = ctx.StringSlice("recipient")
+			backupIdentity = ctx.String("identity")
+			backupAllowPlaintext = ctx.Bool("allow-plaintext-backups")
+			backupAllowUnverified = ctx.Bool("allow-unverified")
+			if err := setBackupTargets(ctx); err != nil {
+				return err
+			}
+			return setMaxFee(ctx)
 		},
 	}
 	app.Setup()
@@ -169,113 +248,162 @@ var getCmd = &cli.Command{
 }
 
 var infoCmd = &cli.Command{
-	Name: "info",
-	Flags: []cli.Flag{
-		&cli.StringFlag{
-			Name: "start",
-		},
-		&cli.StringFlag{
-			Name: "finish",
+	Name:  "info",
+	Usage: "info <minerID|worker>... prints the hour of the zeroth deadline of each miner",
+	Flags: append([]cli.Flag{
+		&cli.BoolFlag{
+			Name:  "all",
+			Usage: "show every miner in the inventory",
 		},
-	},
+	}, filterWindowFlags...),
 	Action: func(c *cli.Context) error {
 		ctx := context.Background()
 
 		threshold := os.Getenv("THRESHOLD")
 		svc := NewService(ctx, threshold)
-		svc.start, _ = time.Parse(time.Kitchen, c.String("start"))
-		svc.finish, _ = time.Parse(time.Kitchen, c.String("finish"))
-
-		if c.Args().Len() < 1 {
-			return fmt.Errorf("please provide a worker address")
-		}
-
-		svc.worker = c.Args().First()
-		err := svc.RestoreMiner(ctx)
-		if err != nil {
-			log.Infof("restoring miner failed: %s", err)
-		}
+		defer svc.closer()
 
-		err = svc.StartMiner(ctx)
+		windows, err := parseWindowFlags(c)
 		if err != nil {
-			return fmt.Errorf("starting miner failed: %w", err)
+			return err
 		}
-		defer svc.StopMiner(ctx)
 
-		err = svc.SetMinerToken(ctx)
-		if err != nil {
-			log.Infof("setting miner token failed: %s", err)
+		keys := c.Args().Slice()
+		if c.Bool("all") {
+			inv, err := OpenInventory()
+			if err != nil {
+				return err
+			}
+			recs, err := inv.List()
+			if err != nil {
+				return err
+			}
+			for _, rec := range recs {
+				if rec.Miner != "" {
+					keys = append(keys, rec.Miner)
+				}
+			}
 		}
-
-		cd, err := svc.GetMinerProvingInfo(ctx)
-		if err != nil {
-			return fmt.Errorf("getting miner proving info failed: %w", err)
+		if len(keys) < 1 {
+			return fmt.Errorf("please provide a miner ID or worker address")
 		}
-		zerothDeadline := GetZerothDeadlineFromCurrentDeadline(cd)
 
-		if c.String("start") != "" && c.String("finish") != "" {
-			if svc.start.Hour() <= zerothDeadline.Hour() && zerothDeadline.Hour() <= svc.finish.Hour() {
-				mapi, mcloser, err := LotusMinerClient(ctx)
+		var failed int
+		for _, key := range keys {
+			maddr, err := address.NewFromString(key)
+			if err != nil {
+				return fmt.Errorf("invalid address %s: %w", key, err)
+			}
+			if maddr.Protocol() != address.ID {
+				maddr, err = NewMiner("", key, "").ResolveMinerAddress(ctx)
 				if err != nil {
-					return err
+					log.Errorf("resolving miner of %s failed: %s", key, err)
+					failed++
+					continue
 				}
-				defer mcloser()
+			}
 
-				maddr, err := mapi.ActorAddress(ctx)
-				if err != nil {
-					return err
-				}
+			cd, err := svc.api.StateMinerProvingDeadline(ctx, maddr, types.EmptyTSK)
+			if err != nil {
+				log.Errorf("getting proving deadline of %s failed: %s", maddr, err)
+				failed++
+				continue
+			}
+			zerothDeadline := GetZerothDeadlineFromCurrentDeadline(svc.clock, cd)
+			hour := zerothDeadline.Hour()
 
-				fmt.Printf("%s\t%s", svc.owner, maddr)
-				return nil
+			switch {
+			case len(windows) > 0:
+				if windows.Contains(zerothDeadline) {
+					fmt.Printf("%s\t%s\n", svc.owner, maddr)
+				}
+			case len(keys) == 1:
+				fmt.Println(hour)
+			default:
+				fmt.Printf("%s\t%d\n", maddr, hour)
 			}
-		} else {
-			fmt.Println(GetZerothDeadlineFromCurrentDeadline(cd).Hour())
 		}
 
+		if failed > 0 {
+			return fmt.Errorf("%d of %d miners failed", failed, len(keys))
+		}
 		return nil
 	},
 }
 
 var backupCmd = &cli.Command{
-	Name: "backup",
+	Name:  "backup",
+	Usage: "backup <worker> archives a miner's repo and worker key",
+	Subcommands: []*cli.Command{
+		backupVerifyCmd,
+		backupListCmd,
+		backupPruneCmd,
+	},
+	Flags: []cli.Flag{
+		&cli.BoolFlag{
+			Name:  "daemon",
+			Usage: "back up through a running lotus-miner instead of reading the repo directly",
+		},
+	},
 	Action: func(c *cli.Context) error {
 		ctx := context.Background()
 
+		if c.Args().Len() < 1 {
+			return fmt.Errorf("please provide a worker address to backup")
+		}
+		// fail before touching the repo rather than after removing it
+		if err := checkBackupEncryption(); err != nil {
+			return err
+		}
+
 		threshold := os.Getenv("THRESHOLD")
 		svc := NewService(ctx, threshold)
 		defer svc.closer()
 
-		if c.Args().Len() < 1 {
-			return fmt.Errorf("please provide a worker address to backup")
-		}
 		svc.worker = c.Args().First()
 
-		err := svc.StartMiner(ctx)
-		if err != nil {
-			return fmt.Errorf("starting miner failed: %w", err)
-		}
-		var stopped bool
-		defer func() {
-			if !stopped {
-				err := svc.StopMiner(ctx)
-				log.Info("stopping miner failed:", err)
+		if c.Bool("daemon") {
+			err := svc.StartMiner(ctx)
+			if err != nil {
+				return fmt.Errorf("starting miner failed: %w", err)
 			}
-		}()
+			var stopped bool
+			defer func() {
+				if !stopped {
+					err := svc.StopMiner(ctx)
+					log.Info("stopping miner failed:", err)
+				}
+			}()
 
-		err = svc.BackupMiner(ctx, 2)
+			err = svc.BackupMiner(ctx, 2)
+			if err != nil {
+				return fmt.Errorf("backing up miner failed: %w", err)
+			}
+			err = svc.StopMiner(ctx)
+			if err != nil {
+				return fmt.Errorf("stopping miner failed: %w", err)
+			}
+			stopped = true
+		} else {
+			err := svc.BackupMinerOffline(ctx, 2)
+			if err != nil {
+				return fmt.Errorf("backing up miner failed: %w", err)
+			}
+		}
+
+		err := svc.RemoveMinerDir(ctx)
 		if err != nil {
-			return fmt.Errorf("backing up miner failed: %w", err)
+			return fmt.Errorf("removing miner dir failed: %w", err)
 		}
-		err = svc.StopMiner(ctx)
+
+		err = svc.ArchiveBackup(ctx)
 		if err != nil {
-			return fmt.Errorf("stopping miner failed: %w", err)
+			return fmt.Errorf("archiving backup failed: %w", err)
 		}
-		stopped = true
 
-		err = svc.RemoveMinerDir(ctx)
+		err = svc.UploadBackup(ctx)
 		if err != nil {
-			return fmt.Errorf("removing miner dir failed: %w", err)
+			return fmt.Errorf("uploading backup failed: %w", err)
 		}
 
 		return nil
@@ -284,81 +412,472 @@ var backupCmd = &cli.Command{
 
 var buyCmd = &cli.Command{
 	Name: "buy",
-	Flags: []cli.Flag{
+	Flags: append([]cli.Flag{
+		&cli.BoolFlag{
+			Name:  "watch",
+			Usage: "keep running and buy a miner on every tipset where gas is below the threshold",
+		},
+		&cli.IntFlag{
+			Name:  "max-per-window",
+			Usage: "maximum number of miners to buy within --window when watching (0 for no limit)",
+		},
+		&cli.DurationFlag{
+			Name:  "window",
+			Usage: "length of the rolling window used by --max-per-window",
+			Value: time.Hour,
+		},
+		&cli.IntFlag{
+			Name:  "max-per-day",
+			Usage: "maximum number of miners to buy per day when watching (0 for no limit)",
+		},
+		&cli.Float64Flag{
+			Name:  "below-percentile",
+			Usage: "buy when gas is below this percentile of the recorded history instead of the threshold",
+		},
 		&cli.StringFlag{
-			Name:     "start",
-			Required: true,
+			Name:  "history-window",
+			Usage: "how much recorded gas history --below-percentile looks at, e.g. 24h or 7d",
+			Value: "7d",
 		},
 		&cli.StringFlag{
-			Name:     "finish",
-			Required: true,
+			Name:  "budget",
+			Usage: "most to spend on gas per miner, e.g. 0.05FIL (overrides $BUDGET)",
 		},
-	},
+		&cli.BoolFlag{
+			Name:  "resume",
+			Usage: "finish purchases a previous run left half done instead of buying new miners",
+		},
+		&cli.IntFlag{
+			Name:  "count",
+			Usage: "number of miners to buy at once",
+			Value: 1,
+		},
+		&cli.BoolFlag{
+			Name:  "predict",
+			Usage: "only buy when the miner's zeroth deadline is predicted to fall in a trading window (requires --count 1)",
+		},
+		&cli.IntFlag{
+			Name:  "predict-wait",
+			Usage: "number of epochs to wait for a favourable prediction before giving up",
+		},
+		maxFeeFlag,
+	}, windowFlags...),
 	Action: func(c *cli.Context) error {
 		ctx := context.Background()
 
+		if err := setMaxFee(c); err != nil {
+			return err
+		}
+		// every purchase ends in a backup, so refuse before spending anything
+		if err := checkBackupEncryption(); err != nil {
+			return err
+		}
+
 		threshold := os.Getenv("THRESHOLD")
-		svc := NewService(ctx, threshold, c.String("start"), c.String("finish"))
-		defer svc.closer()
+		windows, err := parseWindowFlags(c)
+		if err != nil {
+			return err
+		}
+		if len(windows) == 0 {
+			return fmt.Errorf("please provide a trading window with --start and --finish or --trade-window")
+		}
 
-		if svc.IsGasPriceBelowThreshold(ctx) {
-			worker, err := svc.CreateBLSWallet(ctx)
+		svc := NewService(ctx, threshold)
+		defer svc.closer()
+		svc.windows = windows
+		svc.predict = c.Bool("predict")
+		// every further miner of a batch takes another actor ID and lands
+		// in a different epoch, so only a single miner can be predicted
+		if svc.predict && c.Int("count") != 1 {
+			return fmt.Errorf("--predict only works with --count 1")
+		}
+		if c.IsSet("budget") {
+			budget, err := types.ParseFIL(c.String("budget"))
 			if err != nil {
-				return fmt.Errorf("creating BLS wallet failed: %w", err)
+				return fmt.Errorf("parsing budget failed: %w", err)
+			}
+			svc.budget = budget
+		}
+		// without a worker to estimate with the budget and max fee would
+		// never allow a purchase, so say so now rather than on every check
+		if !big.Int(svc.budget).Nil() && big.Int(svc.budget).GreaterThan(big.Zero()) {
+			if _, err := svc.estimationWorker(ctx); err != nil {
+				return fmt.Errorf("--budget needs a worker to estimate with: %w", err)
+			}
+		}
+		if !maxFee.IsZero() {
+			if _, err := svc.estimationWorker(ctx); err != nil {
+				return fmt.Errorf("--max-fee needs a worker to estimate with: %w", err)
 			}
-			svc.worker = worker
-			log.Info(worker)
-			log.Info("initing miner")
-			err = svc.InitMiner(ctx)
+		}
+
+		if c.IsSet("below-percentile") {
+			svc.percentile = c.Float64("below-percentile")
+			if svc.percentile <= 0 || svc.percentile > 100 {
+				return fmt.Errorf("percentile must be between 0 and 100")
+			}
+
+			svc.historyWindow, err = parseWindow(c.String("history-window"))
 			if err != nil {
-				return fmt.Errorf("init miner failed: %w", err)
+				return err
 			}
 
-			log.Info("starting miner")
-			err = svc.StartMiner(ctx)
+			svc.gasHistory, err = OpenGasHistory()
 			if err != nil {
-				return fmt.Errorf("starting miner failed: %w", err)
+				return err
 			}
-			defer svc.StopMiner(ctx)
+		}
 
-			err = svc.SetMinerToken(ctx)
+		if c.Bool("resume") {
+			ps, err := svc.ResumePurchases(ctx)
 			if err != nil {
-				return fmt.Errorf("setting miner token failed: %w", err)
+				return err
 			}
+			printPurchases(ps)
+			return purchaseErrors(ps)
+		}
+
+		if c.Int("count") < 1 {
+			return fmt.Errorf("count must be at least 1")
+		}
 
-			// get the timestamp of the zeroth deadline
-			cd, err := svc.GetMinerProvingInfo(ctx)
+		if c.Bool("watch") {
+			quota := &buyQuota{
+				window:    c.Duration("window"),
+				perWindow: c.Int("max-per-window"),
+				perDay:    c.Int("max-per-day"),
+			}
+
+			sctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+			defer stop()
+
+			return svc.Watch(sctx, quota, c.Int("count"))
+		}
+
+		if svc.predict {
+			ok, err := svc.WaitForPredictedWindow(ctx, c.Int("predict-wait"))
 			if err != nil {
-				return fmt.Errorf("getting miner proving info failed: %w", err)
+				return fmt.Errorf("predicting zeroth deadline failed: %w", err)
 			}
-			zerothDeadline := GetZerothDeadlineFromCurrentDeadline(cd)
-
-			log.Info(zerothDeadline.Hour())
-			log.Info(svc.start.Hour())
-			log.Info(svc.finish.Hour())
-			// if the zeroth deadline is between the time range set, backup miner
-			if zerothDeadline.Hour() >= svc.start.Hour() && zerothDeadline.Hour() <= svc.finish.Hour() {
-				log.Info("backing up miner; in tz")
-				err = svc.BackupMiner(ctx, 1)
-				if err != nil {
-					return fmt.Errorf("backing up miner failed: %w", err)
-				}
-			} else {
-				log.Info("backing up miner; not in tz")
-				svc.BackupMiner(ctx, 0)
-				if err != nil {
-					return fmt.Errorf("backing up sell miner failed: %w", err)
-				}
+			if !ok {
+				log.Info("no favourable zeroth deadline predicted; not buying")
+				return nil
 			}
+		}
+
+		if !svc.IsGasPriceBelowThreshold(ctx) {
+			return nil
+		}
+
+		ps := svc.BuyMany(ctx, c.Int("count"))
+		printPurchases(ps)
+		return purchaseErrors(ps)
+	},
+}
+
+// purchaseErrors returns an error if any of the purchases failed
+func purchaseErrors(ps []*purchase) error {
+	var failed int
+	for _, p := range ps {
+		if p.err != nil {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d purchases failed", failed, len(ps))
+	}
+	return nil
+}
+
+// inWindow reports whether t falls in one of the trading windows
+func (s *Service) inWindow(t time.Time) bool {
+	return s.windows.Contains(t)
+}
+
+// purchase tracks a single miner bought by BuyMany
+type purchase struct {
+	worker address.Address
+	p2pSk  crypto.PrivKey
+	msg    cid.Cid
+	maddr  address.Address
+	step   purchaseStep
+	err    error
+
+	// started is when the purchase's wallet was created
+	started time.Time
+}
 
+// Buy buys a single miner
+func (s *Service) Buy(ctx context.Context) error {
+	return s.BuyMany(ctx, 1)[0].err
+}
+
+// BuyMany pushes n CreateMiner messages, waits for all of them concurrently and
+// then builds, classifies and backs up each miner that was created.
+func (s *Service) BuyMany(ctx context.Context, n int) []*purchase {
+	if n < 1 {
+		return nil
+	}
+
+	owner, err := address.NewFromString(s.owner)
+	if err != nil {
+		err = fmt.Errorf("parsing owner address failed: %w", err)
+	}
+
+	// messages are pushed one after another so the mpool hands out the
+	// owner's nonces in order
+	ps := make([]*purchase, n)
+	for i := range ps {
+		p := &purchase{}
+		ps[i] = p
+		if err != nil {
+			p.err = err
+			continue
+		}
+
+		err = s.pushPurchase(ctx, owner, p)
+		if err != nil {
+			p.err = err
+			s.abandonUnpushed(ctx, owner, p)
+			// a failed push leaves a gap in the nonces, don't push any more
+			err = fmt.Errorf("not pushed after earlier failure: %w", err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	for _, p := range ps {
+		if p.err != nil {
+			continue
+		}
+
+		wg.Add(1)
+		go func(p *purchase) {
+			defer wg.Done()
+			s.waitMiner(ctx, p)
+		}(p)
+	}
+	wg.Wait()
+
+	// finishing touches the service's worker and miner, so run one at a time
+	for _, p := range ps {
+		if p.err != nil {
+			continue
+		}
+		p.err = s.finishPurchase(ctx, p)
+	}
+
+	return ps
+}
+
+func (s *Service) pushPurchase(ctx context.Context, owner address.Address, p *purchase) error {
+	// PushMessage would refuse a message over the max fee, but only after a
+	// wallet was made for it, so check the fee before making one
+	if !maxFee.IsZero() {
+		cost, err := s.EstimateCreateMinerCost(ctx)
+		if err != nil {
+			return fmt.Errorf("estimating CreateMiner fee failed: %w", err)
+		}
+		if cost.Total().GreaterThan(maxFee) {
+			return fmt.Errorf("estimated fee %s exceeds max fee %s", types.FIL(cost.Total()), types.FIL(maxFee))
+		}
+	}
+
+	worker, err := s.api.WalletNew(ctx, types.KTBLS)
+	if err != nil {
+		return fmt.Errorf("creating BLS wallet failed: %w", err)
+	}
+	p.worker = worker
+	log.Info(worker)
+
+	p.p2pSk, _, err = crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		return fmt.Errorf("generating libp2p key failed: %w", err)
+	}
+
+	peerid, err := peer.IDFromPrivateKey(p.p2pSk)
+	if err != nil {
+		return fmt.Errorf("getting peer ID from libp2p key failed: %w", err)
+	}
+
+	err = p.journal(stepWalletCreated)
+	if err != nil {
+		return fmt.Errorf("journaling wallet failed: %w", err)
+	}
+
+	// the head may have moved since the purchase was decided on, so check the
+	// prediction again for this worker right before pushing
+	if s.predict {
+		zd, err := s.PredictZerothDeadline(ctx, worker)
+		if err != nil {
+			return fmt.Errorf("predicting zeroth deadline failed: %w", err)
+		}
+		if !s.inWindow(zd) {
+			return fmt.Errorf("predicted zeroth deadline hour %d moved outside of the trading window", zd.Hour())
+		}
+	}
+
+	log.Info("creating miner")
+	p.msg, err = PushCreateMiner(ctx, s.api, owner, worker, peerid)
+	if err != nil {
+		return fmt.Errorf("creating miner failed: %w", err)
+	}
+
+	return p.journal(stepMessagePushed)
+}
+
+// finishPurchase builds the repo of a created miner, backs it up and marks it
+// in the inventory to keep or sell depending on when its zeroth deadline
+// falls. Steps the purchase already completed are skipped.
+func (s *Service) finishPurchase(ctx context.Context, p *purchase) error {
+	s.worker = p.worker.String()
+	s.id = p.maddr.String()
+	backuppath := home(s.BackupDir(), "lotusminer")
+
+	inv, err := OpenInventory()
+	if err != nil {
+		return err
+	}
+
+	if p.step < stepBackedUp {
+		cost, epoch, err := MessageGasCost(ctx, s.api, p.msg)
+		if err != nil {
+			log.Infof("looking up cost of %s failed: %s", p.msg, err)
+		}
+		receipt, err := CreateMinerReceipt(ctx, s.api, p.msg)
+		if err != nil {
+			log.Infof("looking up receipt of %s failed: %s", p.msg, err)
+		}
+
+		err = inv.Set(s.worker, func(rec *MinerRecord) {
+			rec.Miner = s.id
+			rec.Owner = s.owner
+			rec.CreatedEpoch = epoch
+			rec.Message = p.msg.String()
+			rec.Receipt = receipt
+			rec.Cost = cost
+			rec.Status = StatusCreated
+		})
+		if err != nil {
+			return fmt.Errorf("recording miner in inventory failed: %w", err)
+		}
+	}
+
+	if p.step < stepRepoInitialised {
+		// a previous attempt may have left a partial repo behind
+		err := os.RemoveAll(s.MinerPath())
+		if err != nil {
+			return fmt.Errorf("removing partial miner repo failed: %w", err)
+		}
+
+		log.Info("initing miner repo")
+		err = s.InitMinerRepo(ctx, p.maddr, p.p2pSk)
+		if err != nil {
+			return fmt.Errorf("init miner repo failed: %w", err)
+		}
+
+		err = p.journal(stepRepoInitialised)
+		if err != nil {
+			return err
+		}
+	}
+
+	if p.step < stepBackedUp {
+		err := s.CreateBackupDir()
+		if err != nil {
+			return err
+		}
+
+		// the repo was built here rather than by lotus-miner, so it is backed
+		// up by moving it into the backup directory
+		if _, err := os.Stat(backuppath); err != nil {
 			log.Info("moving miner dir")
-			err = svc.RemoveMinerDir(ctx)
+			err = s.RemoveMinerDir(ctx)
 			if err != nil {
 				return fmt.Errorf("removing miner dir failed: %w", err)
 			}
 		}
-		return nil
-	},
+
+		err = inv.SetStatus(s.worker, StatusBackedUp)
+		if err != nil {
+			return fmt.Errorf("recording backup in inventory failed: %w", err)
+		}
+
+		err = p.journal(stepBackedUp)
+		if err != nil {
+			return err
+		}
+	}
+
+	// get the timestamp of the zeroth deadline
+	cd, err := s.api.StateMinerProvingDeadline(ctx, p.maddr, types.EmptyTSK)
+	if err != nil {
+		return fmt.Errorf("getting miner proving info failed: %w", err)
+	}
+	zerothDeadline := GetZerothDeadlineFromCurrentDeadline(s.clock, cd)
+
+	log.Infof("zeroth deadline at %s, trading windows %v", zerothDeadline.Format(time.Kitchen), s.windows)
+	// if the zeroth deadline is between the time range set, keep the miner
+	status := StatusForSale
+	if s.inWindow(zerothDeadline) {
+		status = StatusKeep
+	}
+	log.Infof("classifying miner as %s", status)
+
+	hour := zerothDeadline.Hour()
+	err = inv.Set(s.worker, func(rec *MinerRecord) {
+		rec.DeadlineHour = &hour
+		rec.Status = status
+	})
+	if err != nil {
+		return fmt.Errorf("recording miner status in inventory failed: %w", err)
+	}
+
+	// a failed archive removes the exported key, so export it on every attempt
+	// until the backup is archived
+	if s.ArchivePath() == "" {
+		err = s.ExportWorkerKey(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	// archive last so the manifest carries the deadline
+	err = s.ArchiveBackup(ctx)
+	if err != nil {
+		return fmt.Errorf("archiving backup failed: %w", err)
+	}
+
+	err = s.UploadBackup(ctx)
+	if err != nil {
+		return fmt.Errorf("uploading backup failed: %w", err)
+	}
+
+	return p.journal(stepClassified)
+}
+
+// printPurchases prints the outcome of every purchase
+func printPurchases(ps []*purchase) {
+	tw := tabwriter.NewWriter(os.Stdout, 2, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "WORKER\tMESSAGE\tMINER\tRESULT")
+	for _, p := range ps {
+		worker, msg, maddr := "-", "-", "-"
+		if p.worker != address.Undef {
+			worker = p.worker.String()
+		}
+		if p.msg.Defined() {
+			msg = p.msg.String()
+		}
+		if p.maddr != address.Undef {
+			maddr = p.maddr.String()
+		}
+
+		result := "ok"
+		if p.err != nil {
+			result = p.err.Error()
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", worker, msg, maddr, result)
+	}
+	tw.Flush()
 }
 
 // CreateBLSWallet creates a BLS wallet that will be the worker address
@@ -371,8 +890,31 @@ func (s *Service) CreateBLSWallet(ctx context.Context) (string, error) {
 	return nk.String(), nil
 }
 
-// IsGasPriceBelowThreshold checks if the gas price is below the threshold
+// IsGasPriceBelowThreshold checks if the gas price is below the threshold. If a
+// percentile is set, the price is compared against the recorded history, and
+// if a budget is set, the full estimated cost of a CreateMiner message is
+// compared against it; with both set, both have to pass. Either replaces the
+// threshold.
 func (s *Service) IsGasPriceBelowThreshold(ctx context.Context) bool {
+	if s.percentile > 0 && !s.IsGasPriceBelowPercentile(ctx) {
+		return false
+	}
+
+	if !big.Int(s.budget).Nil() && big.Int(s.budget).GreaterThan(big.Zero()) {
+		cost, err := s.EstimateCreateMinerCost(ctx)
+		if err != nil {
+			log.Infof("estimating create miner cost failed: %s", err)
+			return false
+		}
+
+		fmt.Printf("create miner: %s (max %s, budget %s)\n", types.FIL(cost.Total()), types.FIL(cost.Max()), s.budget)
+		return cost.Total().LessThan(big.Int(s.budget))
+	}
+
+	if s.percentile > 0 {
+		return true
+	}
+
 	est, err := s.GetGasPrice(ctx)
 	if err != nil {
 		return false
@@ -384,7 +926,10 @@ func (s *Service) IsGasPriceBelowThreshold(ctx context.Context) bool {
 // GetGasPrice gets the estimated gas price for the next 5 blocks
 func (s *Service) GetGasPrice(ctx context.Context) (int64, error) {
 	nblocks := 2
-	addr := builtin.SystemActorAddr // TODO: make real when used in GasEstimateGasPremium
+	addr, err := address.NewFromString(s.owner)
+	if err != nil {
+		return 0, fmt.Errorf("parsing owner address: %w", err)
+	}
 
 	est, err := s.api.GasEstimateGasPremium(ctx, uint64(nblocks), addr, 10000, types.EmptyTSK)
 	if err != nil {
@@ -397,20 +942,46 @@ func (s *Service) GetGasPrice(ctx context.Context) (int64, error) {
 
 // LotusClient returns a JSONRPC client for the Lotus API
 func LotusClient(ctx context.Context) (lotusapi.FullNode, jsonrpc.ClientCloser, error) {
-	authToken := os.Getenv("LOTUS_TOKEN")
+	return lotusClient(ctx, os.Getenv("LOTUS_API"), os.Getenv("LOTUS_TOKEN"))
+}
+
+// lotusClient returns a JSONRPC client for the Lotus API at addr, given as
+// host:port or as a multiaddr
+func lotusClient(ctx context.Context, addr, authToken string) (lotusapi.FullNode, jsonrpc.ClientCloser, error) {
 	headers := http.Header{"Authorization": []string{"Bearer " + authToken}}
-	addr := os.Getenv("LOTUS_API")
+	addr, err := dialAddr(addr)
+	if err != nil {
+		return nil, nil, err
+	}
 
 	return client.NewFullNodeRPCV1(ctx, "ws://"+addr+"/rpc/v1", headers)
 }
 
+// dialAddr returns the host:port of an API address given as host:port or as
+// a multiaddr like the ones in FULLNODE_API_INFO and the repo api files
+func dialAddr(addr string) (string, error) {
+	if !strings.HasPrefix(addr, "/") {
+		return addr, nil
+	}
+	return apiHostPort(addr)
+}
+
 func LotusMinerClient(ctx context.Context) (lotusapi.StorageMiner, jsonrpc.ClientCloser, error) {
-	authToken := os.Getenv("LOTUSMINER_TOKEN")
-	headers := http.Header{"Authorization": []string{"Bearer " + authToken}}
 	addr := os.Getenv("LOTUSMINER_API")
 	if addr == "" {
 		addr = "127.0.0.1:2345"
 	}
+	return lotusMinerClient(ctx, addr, os.Getenv("LOTUSMINER_TOKEN"))
+}
+
+// lotusMinerClient returns a JSONRPC client for the miner API at addr, given
+// as host:port or as a multiaddr
+func lotusMinerClient(ctx context.Context, addr, authToken string) (lotusapi.StorageMiner, jsonrpc.ClientCloser, error) {
+	headers := http.Header{"Authorization": []string{"Bearer " + authToken}}
+	addr, err := dialAddr(addr)
+	if err != nil {
+		return nil, nil, err
+	}
 
 	return client.NewStorageMinerRPCV0(ctx, "ws://"+addr+"/rpc/v0", headers)
 }
@@ -473,9 +1044,9 @@ func (s *Service) GetMinerProvingInfo(ctx context.Context) (*dline.Info, error)
 
 // GetZerothDeadlineFromCurrentDeadline returns the hour of day that the zeroth deadline
 // gets challenged
-func GetZerothDeadlineFromCurrentDeadline(dl *dline.Info) time.Time {
+func GetZerothDeadlineFromCurrentDeadline(clock *EpochClock, dl *dline.Info) time.Time {
 	di0do := dl.CurrentEpoch - (dl.CurrentEpoch - dl.Open + abi.ChainEpoch(int64(dl.Index)*int64(miner.WPoStChallengeWindow)))
-	return EpochTimestamp(di0do)
+	return clock.Time(di0do)
 }
 
 func (s *Service) SetMinerToken(ctx context.Context) error {
@@ -555,13 +1126,13 @@ func (s Miner) transferOwnership(ctx context.Context, new string) error {
 		return fmt.Errorf("serializing params: %w", err)
 	}
 
-	smsg, err := api.MpoolPushMessage(ctx, &types.Message{
+	smsg, err := PushMessage(ctx, api, &types.Message{
 		From:   fromAddrId,
 		To:     maddr,
 		Method: miner.Methods.ChangeOwnerAddress,
 		Value:  big.Zero(),
 		Params: sp,
-	}, nil)
+	})
 	if err != nil {
 		return fmt.Errorf("mpool push: %w", err)
 	}
@@ -569,8 +1140,7 @@ func (s Miner) transferOwnership(ctx context.Context, new string) error {
 	fmt.Println("Message CID:", smsg.Cid())
 
 	// wait for it to get mined into a block
-	wait, err := api.StateWaitMsg(ctx, smsg.Cid(), build.MessageConfidence, abi.ChainEpoch(4), false)
-	// wait, err := api.StateWaitMsg(ctx, smsg.Cid(), build.MessageConfidence)
+	wait, err := WaitMessage(ctx, api, smsg.Cid())
 	if err != nil {
 		return err
 	}
@@ -665,9 +1235,16 @@ var bulkTransferCmd = &cli.Command{
 var transferCmd = &cli.Command{
 	Name:  "transfer",
 	Usage: "newAddr senderAddr minerID",
+	Flags: []cli.Flag{
+		maxFeeFlag,
+	},
 	Action: func(cctx *cli.Context) error {
 		ctx := context.Background()
 
+		if err := setMaxFee(cctx); err != nil {
+			return err
+		}
+
 		api, acloser, err := LotusClient(ctx)
 		if err != nil {
 			return err
@@ -713,13 +1290,13 @@ var transferCmd = &cli.Command{
 			return fmt.Errorf("serializing params: %w", err)
 		}
 
-		smsg, err := api.MpoolPushMessage(ctx, &types.Message{
+		smsg, err := PushMessage(ctx, api, &types.Message{
 			From:   fromAddrId,
 			To:     maddr,
 			Method: miner.Methods.ChangeOwnerAddress,
 			Value:  big.Zero(),
 			Params: sp,
-		}, nil)
+		})
 		if err != nil {
 			return fmt.Errorf("mpool push: %w", err)
 		}
@@ -727,7 +1304,7 @@ var transferCmd = &cli.Command{
 		fmt.Println("Message CID:", smsg.Cid())
 
 		// wait for it to get mined into a block
-		wait, err := api.StateWaitMsg(ctx, smsg.Cid(), build.MessageConfidence, lotusapi.LookbackNoLimit, true)
+		wait, err := WaitMessage(ctx, api, smsg.Cid())
 		if err != nil {
 			return err
 		}
@@ -3,44 +3,64 @@ package main
 import (
 	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"os"
 	"os/exec"
+	"strings"
+	"sync"
 	"time"
+
+	"github.com/filecoin-project/go-address"
+	lotusapi "github.com/filecoin-project/lotus/api"
 )
 
-// InitMiner uses the lotus-miner cli to initialize a miner
-func (s *Service) InitMiner(ctx context.Context) error {
-	args := []string{"init", "--owner=" + s.owner, "--worker=" + s.worker, "--no-local-storage"}
+const (
+	// minerStartTimeout is how long StartMiner waits for lotus-miner to
+	// answer on its API
+	minerStartTimeout = 3 * time.Minute
+	// minerStopTimeout is how long StopMiner waits for lotus-miner to exit
+	minerStopTimeout = time.Minute
+	// minerStderrLines is how many lines of lotus-miner's stderr are kept
+	// for errors
+	minerStderrLines = 20
+)
 
-	cmd := exec.CommandContext(ctx, "lotus-miner", args...)
-	cmd.Env = append(os.Environ(), s.MinerPathEnv(), "TRUST_PARAMS=1")
-	if debug {
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-	} else {
-		cmd.Stdout = ioutil.Discard
-		cmd.Stderr = ioutil.Discard
+// RestoreMiner uses the lotus-miner cli to restore a miner
+func (s *Service) RestoreMiner(ctx context.Context) error {
+	// confirm that there is no lotusminer directory
+	if _, err := os.Stat(s.MinerPath()); err == nil {
+		log.Debugf("miner repo %s exists, not restoring it", s.MinerPath())
+		return nil
 	}
-	err := cmd.Run()
+
+	dir, cleanup, err := s.OpenBackup(ctx)
 	if err != nil {
 		return err
 	}
-	return nil
+	defer cleanup()
+
+	return s.restoreFrom(ctx, dir, s.MinerPath())
 }
 
-// RestoreMiner uses the lotus-miner cli to restore a miner
-func (s *Service) RestoreMiner(ctx context.Context) error {
-	// confirm that there is no lotusminer directory
-	if _, err := os.Stat(s.MinerPath()); err == nil {
+// restoreFrom restores the miner repo at path from the plaintext backup in dir
+func (s *Service) restoreFrom(ctx context.Context, dir, path string) error {
+	// miners bought natively have no lotus-miner backup, only the repo that
+	// was moved aside by RemoveMinerDir
+	if _, err := os.Stat(home(dir, "bak")); os.IsNotExist(err) {
+		err := CopyDir(home(dir, "lotusminer"), path)
+		if err != nil {
+			return fmt.Errorf("error copying miner repo from backup: %w", err)
+		}
 		return nil
 	}
 
 	{
-		args := []string{"init", "restore", fmt.Sprintf(home(s.h, ".lotusbackup/%s/bak"), s.worker)}
+		args := []string{"init", "restore", home(dir, "bak")}
 
 		cmd := exec.CommandContext(ctx, "lotus-miner", args...)
-		cmd.Env = append(os.Environ(), "TRUST_PARAMS=1", s.MinerPathEnv())
+		cmd.Env = append(os.Environ(), "TRUST_PARAMS=1", "LOTUS_MINER_PATH="+path)
 		if debug {
 			cmd.Stdout = os.Stdout
 			cmd.Stderr = os.Stderr
@@ -54,8 +74,15 @@ func (s *Service) RestoreMiner(ctx context.Context) error {
 		}
 	}
 
+	// the lotus-miner backup format has no keystore; offline backups keep it
+	// next to it
+	err := restoreKeystore(home(dir, "keystore"), path)
+	if err != nil {
+		return fmt.Errorf("error restoring keystore: %w", err)
+	}
+
 	// create empty storage.json file
-	err := ioutil.WriteFile(s.MinerPath()+"/storage.json", []byte("{}"), 0644)
+	err = ioutil.WriteFile(path+"/storage.json", []byte("{}"), 0644)
 	if err != nil {
 		return fmt.Errorf("error writing storage.json: %s", err)
 	}
@@ -63,33 +90,181 @@ func (s *Service) RestoreMiner(ctx context.Context) error {
 	return nil
 }
 
-// StartMiner uses the lotus-miner cli to start a miner
+// StartMiner uses the lotus-miner cli to start a miner and waits until its
+// API answers. It fails with the last lines of the miner's stderr if the
+// miner exits or does not come up in time.
 func (s *Service) StartMiner(ctx context.Context) error {
 	args := []string{"run"}
 
+	// don't reach a miner started before this one
+	s.minerAPI, s.minerToken = "", ""
+
+	stderr := &tailWriter{max: minerStderrLines}
 	cmd := exec.CommandContext(ctx, "lotus-miner", args...)
-	cmd.Env = append(os.Environ(), s.MinerPathEnv(), "TRUST_PARAMS=1")
+	cmd.Env = s.minerEnv("TRUST_PARAMS=1")
 	if debug {
 		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
+		cmd.Stderr = io.MultiWriter(os.Stderr, stderr)
 	} else {
 		cmd.Stdout = ioutil.Discard
-		cmd.Stderr = ioutil.Discard
+		cmd.Stderr = stderr
 	}
 	err := cmd.Start()
 	if err != nil {
 		return err
 	}
-	time.Sleep(time.Second * 10)
+
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+	s.minerExited = exited
+
+	tctx, cancel := context.WithTimeout(ctx, minerStartTimeout)
+	defer cancel()
+
+	backoff := 250 * time.Millisecond
+	for {
+		err := s.probeMiner(tctx)
+		if err == nil {
+			return nil
+		}
+		log.Debugf("waiting for lotus-miner to come up: %s", err)
+
+		select {
+		case werr := <-exited:
+			s.minerExited = nil
+			if werr == nil {
+				werr = fmt.Errorf("exit status 0")
+			}
+			return fmt.Errorf("lotus-miner exited during startup: %w\n%s", werr, stderr)
+		case <-tctx.Done():
+			// don't leave a miner behind that we gave up on
+			_ = cmd.Process.Kill()
+			<-exited
+			s.minerExited = nil
+			return fmt.Errorf("lotus-miner did not come up within %s: %w\n%s", minerStartTimeout, err, stderr)
+		case <-time.After(backoff):
+		}
+
+		if backoff *= 2; backoff > 5*time.Second {
+			backoff = 5 * time.Second
+		}
+	}
+}
+
+// probeMiner checks that the miner's repo has its api and token files and
+// that its API answers, and keeps them for the miner API client
+func (s *Service) probeMiner(ctx context.Context) error {
+	apib, err := ioutil.ReadFile(home(s.MinerPath(), "api"))
+	if err != nil {
+		return err
+	}
+	token, err := ioutil.ReadFile(home(s.MinerPath(), "token"))
+	if err != nil {
+		return err
+	}
+	addr := strings.TrimSpace(string(apib))
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	miner, closer, err := lotusMinerClient(ctx, addr, string(token))
+	if err != nil {
+		return err
+	}
+	defer closer()
+
+	if _, err := miner.ActorAddress(ctx); err != nil {
+		return err
+	}
+
+	s.minerAPI = addr
+	s.minerToken = string(token)
 	return nil
 }
 
+// minerEnv is the environment of the lotus-miner commands run against the
+// miner's repo. Miner API settings from the shell or profile are replaced
+// so that they cannot point a command at another miner.
+func (s *Service) minerEnv(extra ...string) []string {
+	var env []string
+	for _, kv := range os.Environ() {
+		switch strings.SplitN(kv, "=", 2)[0] {
+		case "MINER_API_INFO", "STORAGE_API_INFO", "LOTUSMINER_API", "LOTUSMINER_TOKEN":
+			continue
+		}
+		env = append(env, kv)
+	}
+	env = append(env, s.MinerPathEnv())
+	if s.minerAPI != "" {
+		env = append(env, "MINER_API_INFO="+s.minerToken+":"+s.minerAPI)
+	}
+	return append(env, extra...)
+}
+
+// apiHostPort turns the multiaddr in a repo's api file into the host:port the
+// API clients dial
+func apiHostPort(maddr string) (string, error) {
+	parts := strings.Split(strings.Trim(maddr, "/"), "/")
+	if len(parts) < 4 || parts[2] != "tcp" {
+		return "", fmt.Errorf("unsupported api address %q", maddr)
+	}
+
+	host := parts[1]
+	switch parts[0] {
+	case "ip4", "ip6", "dns", "dns4", "dns6":
+	default:
+		return "", fmt.Errorf("unsupported api address %q", maddr)
+	}
+	// a miner listening on every interface is reached on loopback
+	switch host {
+	case "0.0.0.0":
+		host = "127.0.0.1"
+	case "::":
+		host = "::1"
+	}
+	return net.JoinHostPort(host, parts[3]), nil
+}
+
+// tailWriter keeps the last max lines written to it
+type tailWriter struct {
+	mu    sync.Mutex
+	max   int
+	lines []string
+	part  string
+}
+
+func (w *tailWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	lines := strings.Split(w.part+string(p), "\n")
+	w.part = lines[len(lines)-1]
+	w.lines = append(w.lines, lines[:len(lines)-1]...)
+	if len(w.lines) > w.max {
+		w.lines = append([]string(nil), w.lines[len(w.lines)-w.max:]...)
+	}
+	return len(p), nil
+}
+
+func (w *tailWriter) String() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	lines := append([]string(nil), w.lines...)
+	if w.part != "" {
+		lines = append(lines, w.part)
+	}
+	return strings.Join(lines, "\n")
+}
+
 // StopMiner uses the lotus-miner cli to stop a miner
 func (s *Service) StopMiner(ctx context.Context) error {
 	args := []string{"stop"}
 
 	cmd := exec.CommandContext(ctx, "lotus-miner", args...)
-	cmd.Env = append(os.Environ(), s.MinerPathEnv())
+	cmd.Env = s.minerEnv()
 	if debug {
 		cmd.Stdout = os.Stdout
 		cmd.Stderr = os.Stderr
@@ -101,39 +276,38 @@ func (s *Service) StopMiner(ctx context.Context) error {
 	if err != nil {
 		return err
 	}
+	s.minerAPI, s.minerToken = "", ""
+
+	// reap the miner started by StartMiner
+	if s.minerExited != nil {
+		select {
+		case <-s.minerExited:
+		case <-time.After(minerStopTimeout):
+			return fmt.Errorf("lotus-miner did not exit within %s", minerStopTimeout)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		s.minerExited = nil
+	}
 	return nil
 }
 
 // BackupMiner creates a backup of the miner
 func (s *Service) BackupMiner(ctx context.Context, inTZ int) error {
-	var err error
-	// write worker address to file
-	if inTZ == 1 {
-		err = AppendFile(home(s.h, "keepminer.list"), []byte(fmt.Sprintf("%s\n", s.worker)))
-		if err != nil {
-			return fmt.Errorf("error appending worker to keepminer.list: %w", err)
-		}
-	} else if inTZ == 0 {
-		err = AppendFile(home(s.h, "sellminer.list"), []byte(fmt.Sprintf("%s\n", s.worker)))
-		if err != nil {
-			return fmt.Errorf("error appending worker to sellminer.list: %w", err)
-		}
-	} else {
-		err = AppendFile(home(s.h, "backupminer.list"), []byte(fmt.Sprintf("%s\n", s.worker)))
-		if err != nil {
-			return fmt.Errorf("error appending worker to backupminer.list: %w", err)
-		}
+	err := s.RecordMiner(inTZ)
+	if err != nil {
+		return err
 	}
 
-	err = os.MkdirAll(fmt.Sprintf(home(s.h, ".lotusbackup/%s"), s.worker), 0755)
+	err = s.CreateBackupDir()
 	if err != nil {
-		return fmt.Errorf("error creating lotusbackup directory: %w", err)
+		return err
 	}
 
 	{
-		args := []string{"backup", fmt.Sprintf(home(s.h, ".lotusbackup/%s/bak"), s.worker)}
+		args := []string{"backup", home(s.BackupDir(), "bak")}
 		cmd := exec.CommandContext(ctx, "lotus-miner", args...)
-		cmd.Env = append(os.Environ(), s.MinerPathEnv())
+		cmd.Env = s.minerEnv()
 		if debug {
 			cmd.Stdout = os.Stdout
 			cmd.Stderr = os.Stderr
@@ -147,24 +321,125 @@ func (s *Service) BackupMiner(ctx context.Context, inTZ int) error {
 		}
 	}
 
-	{
-		args := []string{"wallet", "export", s.worker}
-		out, err := exec.Command("lotus", args...).Output()
-		if err != nil {
-			return fmt.Errorf("error running lotus wallet export: %w", err)
+	return s.ExportWorkerKey(ctx)
+}
+
+// BackupMinerOffline creates a backup of the miner straight from its repo,
+// without a running lotus-miner
+func (s *Service) BackupMinerOffline(ctx context.Context, inTZ int) error {
+	err := s.RecordMiner(inTZ)
+	if err != nil {
+		return err
+	}
+
+	err = s.CreateBackupDir()
+	if err != nil {
+		return err
+	}
+
+	err = s.BackupRepo(ctx)
+	if err != nil {
+		return fmt.Errorf("error backing up miner repo: %w", err)
+	}
+
+	return s.ExportWorkerKey(ctx)
+}
+
+// RecordMiner sets the miner's status in the inventory: keep when inTZ is 1,
+// for sale when it is 0 and backed up otherwise. Backed up only replaces the
+// created status, so backing a miner up again keeps its place in the lifecycle.
+func (s *Service) RecordMiner(inTZ int) error {
+	status := StatusBackedUp
+	if inTZ == 1 {
+		status = StatusKeep
+	} else if inTZ == 0 {
+		status = StatusForSale
+	}
+
+	inv, err := OpenInventory()
+	if err != nil {
+		return err
+	}
+
+	err = inv.Set(s.worker, func(rec *MinerRecord) {
+		if s.id != "" {
+			rec.Miner = s.id
 		}
-		err = ioutil.WriteFile(fmt.Sprintf(home(s.h, ".lotusbackup/%s/key"), s.worker), out, 0644)
-		if err != nil {
-			return fmt.Errorf("error writing wallet export: %w", err)
+		if status != StatusBackedUp || rec.Status == StatusCreated || rec.Status == "" {
+			rec.Status = status
 		}
+	})
+	if err != nil {
+		return fmt.Errorf("error recording miner in inventory: %w", err)
 	}
+	return nil
+}
 
+// CreateBackupDir creates the directory holding the miner's backups
+func (s *Service) CreateBackupDir() error {
+	// backups hold worker keys, so only the owner may read them
+	err := os.MkdirAll(s.BackupDir(), 0700)
+	if err != nil {
+		return fmt.Errorf("error creating lotusbackup directory: %w", err)
+	}
+	// MkdirAll leaves directories made by older versions as they were
+	for _, dir := range []string{s.BackupRoot(), s.BackupDir()} {
+		if err := os.Chmod(dir, 0700); err != nil {
+			return fmt.Errorf("error restricting lotusbackup directory: %w", err)
+		}
+	}
+	return nil
+}
+
+// ExportWorkerKey writes the worker's private key next to the miner backup
+func (s *Service) ExportWorkerKey(ctx context.Context) error {
+	args := []string{"wallet", "export", s.worker}
+	out, err := exec.CommandContext(ctx, "lotus", args...).Output()
+	if err != nil {
+		return fmt.Errorf("error running lotus wallet export: %w", err)
+	}
+	err = ioutil.WriteFile(home(s.BackupDir(), "key"), out, 0600)
+	if err != nil {
+		return fmt.Errorf("error writing wallet export: %w", err)
+	}
+	// WriteFile keeps the mode of a key exported by an older version
+	return os.Chmod(home(s.BackupDir(), "key"), 0600)
+}
+
+// ImportWorkerKey imports the worker's private key from a backed up key file
+// into the given lotus node, unless the node has it already
+func (s *Service) ImportWorkerKey(ctx context.Context, node lotusapi.FullNode, file string) error {
+	waddr, err := address.NewFromString(s.worker)
+	if err != nil {
+		return fmt.Errorf("invalid worker address: %w", err)
+	}
+
+	has, err := node.WalletHas(ctx, waddr)
+	if err != nil {
+		return fmt.Errorf("error checking wallet: %w", err)
+	}
+	if has {
+		return nil
+	}
+
+	ki, err := readKeyFile(file)
+	if err != nil {
+		return fmt.Errorf("error reading worker key: %w", err)
+	}
+
+	addr, err := node.WalletImport(ctx, ki)
+	if err != nil {
+		return fmt.Errorf("error importing worker key: %w", err)
+	}
+	if addr != waddr {
+		return fmt.Errorf("backed up key is for %s, not the worker %s", addr, waddr)
+	}
 	return nil
 }
 
 // RemoveMinerDir removes the miner directory
 func (s *Service) RemoveMinerDir(ctx context.Context) error {
-	backuppath := home(s.h, fmt.Sprintf(".lotusbackup/%s/lotusminer", s.worker))
+	backuppath := home(s.BackupDir(), "lotusminer")
 
 	err := os.Rename(s.MinerPath(), backuppath)
 	if err != nil {
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestTailWriter(t *testing.T) {
+	tests := []struct {
+		name   string
+		max    int
+		writes []string
+		want   string
+	}{
+		{"nothing written", 3, nil, ""},
+		{"partial line", 3, []string{"a"}, "a"},
+		{"line split across writes", 3, []string{"ab", "c\nd", "e\n"}, "abc\nde"},
+		{"fewer lines than max", 3, []string{"a\nb\n"}, "a\nb"},
+		{"writes that wrap", 3, []string{"a\nb\n", "c\nd\n", "e\n"}, "c\nd\ne"},
+		{"wrap keeps the partial line", 2, []string{"a\nb\nc\n", "d"}, "b\nc\nd"},
+		{"single write larger than max", 2, []string{"a\nb\nc\nd\ne\n"}, "d\ne"},
+		{"empty lines count", 2, []string{"a\n\n\n"}, "\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := &tailWriter{max: tt.max}
+			for _, s := range tt.writes {
+				n, err := w.Write([]byte(s))
+				if err != nil || n != len(s) {
+					t.Fatalf("Write(%q) = %d, %v", s, n, err)
+				}
+			}
+			if len(w.lines) > tt.max {
+				t.Errorf("kept %d lines, max %d", len(w.lines), tt.max)
+			}
+			if got := w.String(); got != tt.want {
+				t.Errorf("String() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAPIHostPort(t *testing.T) {
+	tests := []struct {
+		maddr string
+		want  string
+	}{
+		{"/ip4/127.0.0.1/tcp/2345/http", "127.0.0.1:2345"},
+		{"/ip4/10.0.0.5/tcp/2345", "10.0.0.5:2345"},
+		{"/ip4/0.0.0.0/tcp/2345/http", "127.0.0.1:2345"},
+		{"/ip6/::1/tcp/2345/http", "[::1]:2345"},
+		{"/ip6/::/tcp/2345/http", "[::1]:2345"},
+		{"/ip6/fe80::1/tcp/2345", "[fe80::1]:2345"},
+		{"/dns/miner.example.com/tcp/2345/http", "miner.example.com:2345"},
+		{"/dns4/miner.example.com/tcp/2345", "miner.example.com:2345"},
+		{"/dns6/miner.example.com/tcp/2345", "miner.example.com:2345"},
+	}
+	for _, tt := range tests {
+		got, err := apiHostPort(tt.maddr)
+		if err != nil {
+			t.Errorf("apiHostPort(%q): %s", tt.maddr, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("apiHostPort(%q) = %s, want %s", tt.maddr, got, tt.want)
+		}
+	}
+
+	for _, maddr := range []string{"", "/ip4/127.0.0.1", "/ip4/127.0.0.1/udp/2345", "/unix/tmp/miner.sock/tcp/1", "127.0.0.1:2345"} {
+		if got, err := apiHostPort(maddr); err == nil {
+			t.Errorf("apiHostPort(%q) = %s, want an error", maddr, got)
+		}
+	}
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	lotusapi "github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/build"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/ipfs/go-cid"
+	"github.com/mitchellh/go-homedir"
+	"github.com/urfave/cli/v2"
+)
+
+// stuckEpochs is how many epochs a pushed message may sit in the mpool before
+// its premium is bumped; zero disables bumping, as does an unset maxFee
+var stuckEpochs = 10
+
+var stuckEpochsFlag = &cli.IntFlag{
+	Name:    "stuck-epochs",
+	Usage:   "epochs to wait for a pushed message before replacing it with a higher premium, within --max-fee (0 to never replace)",
+	EnvVars: []string{"STUCK_EPOCHS"},
+	Value:   stuckEpochs,
+}
+
+// Replacement records a pushed message being replaced with a higher premium
+type Replacement struct {
+	Time       time.Time
+	Epoch      abi.ChainEpoch
+	From       address.Address
+	Nonce      uint64
+	Old        cid.Cid
+	New        cid.Cid
+	OldPremium abi.TokenAmount
+	NewPremium abi.TokenAmount
+	GasFeeCap  abi.TokenAmount
+}
+
+func replacementsFile() (string, error) {
+	h, err := homedir.Dir()
+	if err != nil {
+		return "", fmt.Errorf("getting home directory failed: %w", err)
+	}
+
+	if err := os.MkdirAll(home(h, ".fil-miner-buyer"), 0755); err != nil {
+		return "", err
+	}
+	return home(h, ".fil-miner-buyer/replacements.jsonl"), nil
+}
+
+func recordReplacement(r Replacement) error {
+	file, err := replacementsFile()
+	if err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return AppendFile(file, append(b, '\n'))
+}
+
+// messageDropEpochs is how many epochs a message may be missing from the
+// mpool without landing before WaitMessage gives up on it
+const messageDropEpochs = 20
+
+// pendingNonce identifies a message in the mpool across its replacements
+type pendingNonce struct {
+	from  address.Address
+	nonce uint64
+}
+
+// nonceBumps is the epoch each pending message was last replaced at. It is
+// shared by every waiter so that a message waited on more than once is
+// bumped once per stuck period rather than once per waiter.
+var nonceBumps = struct {
+	sync.Mutex
+	last map[pendingNonce]abi.ChainEpoch
+}{last: map[pendingNonce]abi.ChainEpoch{}}
+
+// WaitMessage waits for the message c to land. If it has not landed within
+// stuckEpochs epochs and maxFee is set, it is replaced with a higher premium,
+// staying within maxFee. Other pending messages of the sender are left
+// alone. It gives up on a message that drops out of the mpool without
+// landing.
+func WaitMessage(ctx context.Context, api lotusapi.FullNode, c cid.Cid) (*lotusapi.MsgLookup, error) {
+	msg, err := api.ChainGetMessage(ctx, c)
+	if err != nil {
+		return nil, fmt.Errorf("getting message %s: %w", c, err)
+	}
+
+	from, err := api.StateAccountKey(ctx, msg.From, types.EmptyTSK)
+	if err != nil {
+		return nil, fmt.Errorf("resolving sender: %w", err)
+	}
+
+	head, err := api.ChainHead(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("getting chain head: %w", err)
+	}
+	pushed, seen := head.Height(), head.Height()
+
+	clock, err := NewEpochClock(ctx, api)
+	if err != nil {
+		return nil, err
+	}
+	ticker := time.NewTicker(clock.BlockDelay)
+	defer ticker.Stop()
+
+	for {
+		lookup, err := api.StateSearchMsg(ctx, types.EmptyTSK, c, lotusapi.LookbackNoLimit, true)
+		if err != nil {
+			return nil, fmt.Errorf("searching for message %s: %w", c, err)
+		}
+		if lookup != nil {
+			// the message landed, wait for it to get enough confirmations
+			return api.StateWaitMsg(ctx, lookup.Message, build.MessageConfidence, lotusapi.LookbackNoLimit, true)
+		}
+
+		head, err := api.ChainHead(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("getting chain head: %w", err)
+		}
+
+		pending, err := isPending(ctx, api, from, msg.Nonce)
+		switch {
+		case err != nil:
+			log.Errorf("looking for message %s in the mpool failed: %s", c, err)
+		case pending:
+			seen = head.Height()
+		case head.Height()-seen >= messageDropEpochs:
+			return nil, fmt.Errorf("message %s left the mpool without landing %d epochs ago", c, head.Height()-seen)
+		}
+
+		if stuckEpochs > 0 && head.Height()-pushed >= abi.ChainEpoch(stuckEpochs) {
+			if maxFee.IsZero() {
+				log.Infof("message %s has not landed after %d epochs; not replacing it without --max-fee", c, head.Height()-pushed)
+			} else {
+				log.Infof("message %s has not landed after %d epochs; bumping premium", c, head.Height()-pushed)
+				if err := bumpMessage(ctx, api, from, msg.Nonce, head.Height()); err != nil {
+					log.Errorf("replacing stuck message %s failed: %s", c, err)
+				}
+			}
+			pushed = head.Height()
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// isPending reports whether the mpool holds a message from the sender with
+// the given nonce
+func isPending(ctx context.Context, api lotusapi.FullNode, from address.Address, nonce uint64) (bool, error) {
+	pending, err := api.MpoolPending(ctx, types.EmptyTSK)
+	if err != nil {
+		return false, err
+	}
+
+	for _, sm := range pending {
+		if sm.Message.From == from && sm.Message.Nonce == nonce {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// bumpMessage replaces the sender's pending message with the given nonce
+// with a higher premium, unless it was already replaced within the last
+// stuckEpochs.
+func bumpMessage(ctx context.Context, api lotusapi.FullNode, from address.Address, nonce uint64, epoch abi.ChainEpoch) error {
+	nonceBumps.Lock()
+	defer nonceBumps.Unlock()
+
+	key := pendingNonce{from: from, nonce: nonce}
+	if last, ok := nonceBumps.last[key]; ok && epoch-last < abi.ChainEpoch(stuckEpochs) {
+		return nil
+	}
+
+	pending, err := api.MpoolPending(ctx, types.EmptyTSK)
+	if err != nil {
+		return fmt.Errorf("getting pending messages: %w", err)
+	}
+
+	for _, sm := range pending {
+		if sm.Message.From != from || sm.Message.Nonce != nonce {
+			continue
+		}
+
+		// only bump once per period even if the replacement fails
+		nonceBumps.last[key] = epoch
+		if err := replaceMessage(ctx, api, sm, epoch); err != nil {
+			return fmt.Errorf("replacing message with nonce %d: %w", nonce, err)
+		}
+		return nil
+	}
+
+	// it landed or left the mpool since WaitMessage looked
+	return nil
+}
+
+// replaceMessage pushes a copy of sm with the premium raised by at least the
+// mpool's minimum replace-by-fee ratio.
+func replaceMessage(ctx context.Context, api lotusapi.FullNode, sm *types.SignedMessage, epoch abi.ChainEpoch) error {
+	msg := sm.Message
+
+	// the mpool only accepts a replacement whose premium is at least 1.25x
+	minRBF := big.Add(big.Div(big.Mul(msg.GasPremium, big.NewInt(5)), big.NewInt(4)), big.NewInt(1))
+
+	msg.GasPremium = big.Zero()
+	msg.GasFeeCap = big.Zero()
+	est, err := api.GasEstimateMessageGas(ctx, &msg, nil, types.EmptyTSK)
+	if err != nil {
+		return fmt.Errorf("estimating gas: %w", err)
+	}
+
+	msg.GasLimit = est.GasLimit
+	msg.GasPremium = big.Max(est.GasPremium, minRBF)
+	msg.GasFeeCap = big.Max(est.GasFeeCap, msg.GasPremium)
+
+	if !maxFee.IsZero() {
+		capped := big.Div(maxFee, big.NewInt(msg.GasLimit))
+		if msg.GasFeeCap.GreaterThan(capped) {
+			msg.GasFeeCap = capped
+		}
+		if msg.GasPremium.GreaterThan(msg.GasFeeCap) {
+			msg.GasPremium = msg.GasFeeCap
+		}
+		if msg.GasPremium.LessThan(minRBF) {
+			return fmt.Errorf("max fee %s does not leave room for a higher premium", types.FIL(maxFee))
+		}
+	}
+
+	signed, err := api.WalletSignMessage(ctx, msg.From, &msg)
+	if err != nil {
+		return fmt.Errorf("signing replacement: %w", err)
+	}
+
+	c, err := api.MpoolPush(ctx, signed)
+	if err != nil {
+		return fmt.Errorf("pushing replacement: %w", err)
+	}
+
+	log.Infof("replaced message %s with %s (premium %s -> %s)", sm.Cid(), c, sm.Message.GasPremium, msg.GasPremium)
+
+	return recordReplacement(Replacement{
+		Time:       time.Now(),
+		Epoch:      epoch,
+		From:       msg.From,
+		Nonce:      msg.Nonce,
+		Old:        sm.Cid(),
+		New:        c,
+		OldPremium: sm.Message.GasPremium,
+		NewPremium: msg.GasPremium,
+		GasFeeCap:  msg.GasFeeCap,
+	})
+}
+
+var replacementsCmd = &cli.Command{
+	Name:  "replacements",
+	Usage: "show stuck messages that were replaced with a higher premium",
+	Action: func(c *cli.Context) error {
+		file, err := replacementsFile()
+		if err != nil {
+			return err
+		}
+
+		content, err := ioutil.ReadFile(file)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 2, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "TIME\tEPOCH\tFROM\tNONCE\tOLD\tNEW\tOLD PREMIUM\tNEW PREMIUM")
+		for _, line := range strings.Split(string(content), "\n") {
+			if line == "" {
+				continue
+			}
+
+			var r Replacement
+			if err := json.Unmarshal([]byte(line), &r); err != nil {
+				return fmt.Errorf("decoding replacement: %w", err)
+			}
+			fmt.Fprintf(tw, "%s\t%d\t%s\t%d\t%s\t%s\t%s\t%s\n", r.Time.Format(time.RFC3339), r.Epoch, r.From, r.Nonce, r.Old, r.New, r.OldPremium, r.NewPremium)
+		}
+		return tw.Flush()
+	},
+}
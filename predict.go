@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/lotus/chain/actors/builtin/miner"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/filecoin-project/specs-actors/actors/builtin"
+	"github.com/minio/blake2b-simd"
+)
+
+// NextActorID returns the ID that will be assigned to the next actor created
+// on chain. CreateMiner is routed through the power actor to the init actor,
+// so this is the ID a miner created in the next epoch will get, provided no
+// other actor is created before it.
+func (s *Service) NextActorID(ctx context.Context, tsk types.TipSetKey) (abi.ActorID, error) {
+	act, err := s.api.StateReadState(ctx, builtin.InitActorAddr, tsk)
+	if err != nil {
+		return 0, fmt.Errorf("reading init actor state: %w", err)
+	}
+
+	st, ok := act.State.(map[string]interface{})
+	if !ok {
+		return 0, fmt.Errorf("unexpected init actor state type %T", act.State)
+	}
+
+	nextID, ok := st["NextID"].(float64)
+	if !ok {
+		return 0, fmt.Errorf("init actor state has no NextID")
+	}
+
+	return abi.ActorID(nextID), nil
+}
+
+// PredictProvingPeriodStart returns the proving period start that the miner
+// actor constructor assigns to a miner with the given ID created at epoch.
+// It mirrors assignProvingPeriodOffset and currentProvingPeriodStart in the
+// miner actor.
+func PredictProvingPeriodStart(id abi.ActorID, epoch abi.ChainEpoch) (abi.ChainEpoch, error) {
+	addr, err := address.NewIDAddress(uint64(id))
+	if err != nil {
+		return 0, err
+	}
+
+	var seed bytes.Buffer
+	if err := addr.MarshalCBOR(&seed); err != nil {
+		return 0, fmt.Errorf("serializing miner address: %w", err)
+	}
+	if err := binary.Write(&seed, binary.BigEndian, epoch); err != nil {
+		return 0, fmt.Errorf("serializing epoch: %w", err)
+	}
+
+	digest := blake2b.Sum256(seed.Bytes())
+	offset := abi.ChainEpoch(binary.BigEndian.Uint64(digest[:8]) % uint64(miner.WPoStProvingPeriod))
+
+	modulus := epoch % miner.WPoStProvingPeriod
+	var progress abi.ChainEpoch
+	if modulus >= offset {
+		progress = modulus - offset
+	} else {
+		progress = miner.WPoStProvingPeriod - (offset - modulus)
+	}
+
+	return epoch - progress, nil
+}
+
+// PredictZerothDeadline predicts when the zeroth deadline of a miner with the
+// given worker, created in the next epoch, would open. A worker that is not on
+// chain yet, or Undef for one that is still to be made, gets its account
+// created by PushCreateMiner just before the miner, which takes the next ID.
+// Both messages carry consecutive owner nonces and normally land in the same
+// tipset.
+func (s *Service) PredictZerothDeadline(ctx context.Context, worker address.Address) (time.Time, error) {
+	head, err := s.api.ChainHead(ctx)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("getting chain head: %w", err)
+	}
+
+	id, err := s.NextActorID(ctx, head.Key())
+	if err != nil {
+		return time.Time{}, err
+	}
+	if worker == address.Undef {
+		id++
+	} else if _, err := s.api.StateLookupID(ctx, worker, head.Key()); err != nil {
+		id++
+	}
+
+	pps, err := PredictProvingPeriodStart(id, head.Height()+1)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	log.Debugf("predicted proving period start %d for miner f0%d", pps, id)
+	return s.clock.Time(pps), nil
+}
+
+// WaitForPredictedWindow checks the prediction once per epoch, for at most
+// maxEpochs epochs, until a miner with a new worker created in the next epoch
+// is predicted to have its zeroth deadline inside the trading window.
+func (s *Service) WaitForPredictedWindow(ctx context.Context, maxEpochs int) (bool, error) {
+	ticker := time.NewTicker(s.clock.BlockDelay)
+	defer ticker.Stop()
+
+	for i := 0; ; i++ {
+		zd, err := s.PredictZerothDeadline(ctx, address.Undef)
+		if err != nil {
+			return false, err
+		}
+		if s.inWindow(zd) {
+			return true, nil
+		}
+		log.Infof("predicted zeroth deadline hour %d is outside of the trading window", zd.Hour())
+
+		if i >= maxEpochs {
+			return false, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return false, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
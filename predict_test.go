@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/filecoin-project/go-state-types/abi"
+)
+
+func TestPredictProvingPeriodStart(t *testing.T) {
+	// computed by assignProvingPeriodOffset and currentProvingPeriodStart of
+	// the specs-actors miner actor; the first is asserted by its
+	// construction test
+	tests := []struct {
+		id    abi.ActorID
+		epoch abi.ChainEpoch
+		want  abi.ChainEpoch
+	}{
+		{1000, 0, -2222},
+		{1000, 1, -1216},
+		{1000, 2879, 2169},
+		{1000, 2880, 1476},
+		{1234, 1000000, 997677},
+		{120000, 1000000, 997992},
+		{1017421, 1137000, 1135688},
+		{1017421, 1137001, 1134695},
+		{2000000, 1500000, 1498462},
+	}
+
+	for _, tt := range tests {
+		got, err := PredictProvingPeriodStart(tt.id, tt.epoch)
+		if err != nil {
+			t.Fatalf("PredictProvingPeriodStart(%d, %d): %s", tt.id, tt.epoch, err)
+		}
+		if got != tt.want {
+			t.Errorf("PredictProvingPeriodStart(%d, %d) = %d, want %d", tt.id, tt.epoch, got, tt.want)
+		}
+		if got > tt.epoch || tt.epoch-got >= 2880 {
+			t.Errorf("PredictProvingPeriodStart(%d, %d) = %d is not in the period containing the epoch", tt.id, tt.epoch, got)
+		}
+	}
+}
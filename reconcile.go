@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	lotusapi "github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/chain/types"
+	miner2 "github.com/filecoin-project/specs-actors/v2/actors/builtin/miner"
+	"github.com/ipfs/go-cid"
+	"github.com/urfave/cli/v2"
+)
+
+// ChainMinerInfo is the part of a miner's on-chain info that we also record,
+// with every address in its key form where one exists
+type ChainMinerInfo struct {
+	Owner        string
+	Worker       string
+	PendingOwner string
+	Controls     []string
+}
+
+// MinerDiff is a field whose recorded value differs from the chain
+type MinerDiff struct {
+	Field string
+	Local string
+	Chain string
+}
+
+// GetChainMinerInfo loads the owner, worker, pending owner and control
+// addresses of a miner from chain.
+func GetChainMinerInfo(ctx context.Context, api lotusapi.FullNode, maddr address.Address) (*ChainMinerInfo, error) {
+	mi, err := api.StateMinerInfo(ctx, maddr, types.EmptyTSK)
+	if err != nil {
+		return nil, fmt.Errorf("getting miner info: %w", err)
+	}
+
+	var info ChainMinerInfo
+	info.Owner, err = accountKey(ctx, api, mi.Owner)
+	if err != nil {
+		return nil, err
+	}
+	info.Worker, err = accountKey(ctx, api, mi.Worker)
+	if err != nil {
+		return nil, err
+	}
+	for _, ca := range mi.ControlAddresses {
+		k, err := accountKey(ctx, api, ca)
+		if err != nil {
+			return nil, err
+		}
+		info.Controls = append(info.Controls, k)
+	}
+
+	pending, err := pendingOwner(ctx, api, maddr)
+	if err != nil {
+		return nil, err
+	}
+	if pending != nil {
+		info.PendingOwner, err = accountKey(ctx, api, *pending)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &info, nil
+}
+
+// accountKey returns the key address behind an ID address, or the ID address
+// itself for actors without one, such as multisigs
+func accountKey(ctx context.Context, api lotusapi.FullNode, addr address.Address) (string, error) {
+	k, err := api.StateAccountKey(ctx, addr, types.EmptyTSK)
+	if err != nil {
+		act, aerr := api.StateGetActor(ctx, addr, types.EmptyTSK)
+		if aerr != nil {
+			return "", fmt.Errorf("resolving %s: %w", addr, err)
+		}
+		log.Debugf("%s is not an account actor (code %s)", addr, act.Code)
+		return addr.String(), nil
+	}
+	return k.String(), nil
+}
+
+// pendingOwner reads the proposed new owner of a miner from its state, as
+// StateMinerInfo does not return it
+func pendingOwner(ctx context.Context, api lotusapi.FullNode, maddr address.Address) (*address.Address, error) {
+	act, err := api.StateReadState(ctx, maddr, types.EmptyTSK)
+	if err != nil {
+		return nil, fmt.Errorf("reading miner state: %w", err)
+	}
+
+	st, ok := act.State.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("unexpected miner state type %T", act.State)
+	}
+	link, ok := st["Info"].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("miner state has no info")
+	}
+	info, ok := link["/"].(string)
+	if !ok {
+		return nil, fmt.Errorf("miner state has no info")
+	}
+
+	c, err := cid.Decode(info)
+	if err != nil {
+		return nil, fmt.Errorf("decoding miner info cid: %w", err)
+	}
+
+	raw, err := api.ChainReadObj(ctx, c)
+	if err != nil {
+		return nil, fmt.Errorf("reading miner info: %w", err)
+	}
+
+	// the layout of MinerInfo has not changed since v2 actors
+	var mi miner2.MinerInfo
+	if err := mi.UnmarshalCBOR(bytes.NewReader(raw)); err != nil {
+		return nil, fmt.Errorf("decoding miner info: %w", err)
+	}
+
+	return mi.PendingOwnerAddress, nil
+}
+
+// sameAddress compares two addresses, resolving them to ID addresses first so
+// that key and ID forms of the same account match
+func sameAddress(ctx context.Context, api lotusapi.FullNode, a, b string) bool {
+	if a == b {
+		return true
+	}
+	if a == "" || b == "" {
+		return false
+	}
+
+	resolve := func(s string) string {
+		addr, err := address.NewFromString(s)
+		if err != nil {
+			return s
+		}
+		id, err := api.StateLookupID(ctx, addr, types.EmptyTSK)
+		if err != nil {
+			return s
+		}
+		return id.String()
+	}
+	return resolve(a) == resolve(b)
+}
+
+// DiffMiner compares a record with what the chain says about the miner
+func DiffMiner(ctx context.Context, api lotusapi.FullNode, rec *MinerRecord, info *ChainMinerInfo) []MinerDiff {
+	var diffs []MinerDiff
+	if !sameAddress(ctx, api, rec.Owner, info.Owner) {
+		diffs = append(diffs, MinerDiff{"owner", rec.Owner, info.Owner})
+	}
+	worker := rec.Worker
+	if rec.CurrentWorker != "" {
+		worker = rec.CurrentWorker
+	}
+	if !sameAddress(ctx, api, worker, info.Worker) {
+		diffs = append(diffs, MinerDiff{"worker", worker, info.Worker})
+	}
+	if !sameAddress(ctx, api, rec.PendingOwner, info.PendingOwner) {
+		diffs = append(diffs, MinerDiff{"pending-owner", rec.PendingOwner, info.PendingOwner})
+	}
+	if strings.Join(rec.Controls, ",") != strings.Join(info.Controls, ",") {
+		diffs = append(diffs, MinerDiff{"controls", strings.Join(rec.Controls, ","), strings.Join(info.Controls, ",")})
+	}
+	return diffs
+}
+
+var reconcileCmd = &cli.Command{
+	Name:  "reconcile",
+	Usage: "compare the inventory with the owner, worker and control addresses on chain",
+	Flags: []cli.Flag{
+		&cli.BoolFlag{
+			Name:  "apply",
+			Usage: "update the inventory to match the chain",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		ctx := context.Background()
+
+		threshold := os.Getenv("THRESHOLD")
+		svc := NewService(ctx, threshold)
+		defer svc.closer()
+
+		inv, err := OpenInventory()
+		if err != nil {
+			return err
+		}
+
+		recs, err := inv.List()
+		if err != nil {
+			return err
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 2, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "MINER\tFIELD\tLOCAL\tCHAIN")
+
+		// one miner failing to load should not keep the rest from being
+		// reconciled
+		var failed int
+		infos := map[string]*ChainMinerInfo{}
+		for _, rec := range recs {
+			if rec.Miner == "" {
+				log.Infof("no miner ID recorded for worker %s; skipping", rec.Worker)
+				continue
+			}
+
+			maddr, err := address.NewFromString(rec.Miner)
+			if err != nil {
+				log.Errorf("invalid miner ID %s: %s", rec.Miner, err)
+				failed++
+				continue
+			}
+
+			info, err := GetChainMinerInfo(ctx, svc.api, maddr)
+			if err != nil {
+				log.Errorf("getting chain info of %s failed: %s", rec.Miner, err)
+				failed++
+				continue
+			}
+
+			diffs := DiffMiner(ctx, svc.api, rec, info)
+			for _, d := range diffs {
+				fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", rec.Miner, d.Field, d.Local, d.Chain)
+			}
+			if len(diffs) > 0 {
+				infos[rec.Worker] = info
+			}
+		}
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+
+		var failedErr error
+		if failed > 0 {
+			failedErr = fmt.Errorf("%d of %d miners could not be reconciled", failed, len(recs))
+		}
+
+		if !c.Bool("apply") || len(infos) == 0 {
+			return failedErr
+		}
+
+		err = inv.Update(func(recs map[string]*MinerRecord) error {
+			for worker, info := range infos {
+				rec, ok := recs[worker]
+				if !ok {
+					continue
+				}
+
+				// a miner we no longer own has been handed over
+				if rec.Owner != "" && !sameAddress(ctx, svc.api, rec.Owner, info.Owner) && rec.Status != StatusSold {
+					rec.Status = StatusTransferred
+				}
+
+				rec.Owner = info.Owner
+				rec.PendingOwner = info.PendingOwner
+				rec.Controls = info.Controls
+				rec.Updated = time.Now()
+				// the record stays keyed by the original worker, which
+				// the repo and backups are stored under
+				if sameAddress(ctx, svc.api, rec.Worker, info.Worker) {
+					rec.CurrentWorker = ""
+				} else {
+					rec.CurrentWorker = info.Worker
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("updated %d records\n", len(infos))
+		return failedErr
+	},
+}
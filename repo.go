@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/filecoin-project/lotus/lib/backupds"
+	"github.com/filecoin-project/lotus/node/repo"
+	"github.com/ipfs/go-datastore"
+	crypto "github.com/libp2p/go-libp2p-core/crypto"
+)
+
+// InitMinerRepo creates the lotus-miner repo for an already created miner,
+// leaving behind what `lotus-miner init --no-local-storage` would: the default
+// config.toml, a keystore holding the libp2p host key, the miner address in
+// the metadata datastore and an empty storage.json.
+func (s Miner) InitMinerRepo(ctx context.Context, maddr address.Address, p2pSk crypto.PrivKey) error {
+	r, err := repo.NewFS(s.MinerPath())
+	if err != nil {
+		return err
+	}
+
+	ok, err := r.Exists()
+	if err != nil {
+		return err
+	}
+	if ok {
+		return fmt.Errorf("repo at '%s' is already initialized", s.MinerPath())
+	}
+
+	if err := r.Init(repo.StorageMiner); err != nil {
+		return fmt.Errorf("initializing repo: %w", err)
+	}
+
+	lr, err := r.Lock(repo.StorageMiner)
+	if err != nil {
+		return err
+	}
+	defer lr.Close()
+
+	ks, err := lr.KeyStore()
+	if err != nil {
+		return fmt.Errorf("opening keystore: %w", err)
+	}
+
+	kbytes, err := p2pSk.Bytes()
+	if err != nil {
+		return err
+	}
+
+	if err := ks.Put("libp2p-host", types.KeyInfo{
+		Type:       "libp2p-host",
+		PrivateKey: kbytes,
+	}); err != nil {
+		return fmt.Errorf("storing libp2p key: %w", err)
+	}
+
+	mds, err := lr.Datastore(ctx, "/metadata")
+	if err != nil {
+		return err
+	}
+
+	if err := mds.Put(datastore.NewKey("miner-address"), maddr.Bytes()); err != nil {
+		return fmt.Errorf("storing miner address: %w", err)
+	}
+
+	// create empty storage.json file
+	err = ioutil.WriteFile(s.MinerPath()+"/storage.json", []byte("{}"), 0644)
+	if err != nil {
+		return fmt.Errorf("error writing storage.json: %s", err)
+	}
+
+	return nil
+}
+
+// BackupRepo writes the miner repo's metadata datastore to the backup
+// directory in the format of `lotus-miner backup`, so `lotus-miner init
+// restore` can read it, along with the keystore that format leaves out. The
+// repo is locked rather than served, so no lotus-miner daemon is needed.
+func (s Miner) BackupRepo(ctx context.Context) error {
+	r, err := repo.NewFS(s.MinerPath())
+	if err != nil {
+		return err
+	}
+
+	lr, err := r.Lock(repo.StorageMiner)
+	if err != nil {
+		return fmt.Errorf("locking repo (is lotus-miner running?): %w", err)
+	}
+	defer lr.Close()
+
+	mds, err := lr.Datastore(ctx, "/metadata")
+	if err != nil {
+		return err
+	}
+
+	bds, err := backupds.Wrap(mds, backupds.NoLogdir)
+	if err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(home(s.BackupDir(), "bak.tmp"), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if err := bds.Backup(out); err != nil {
+		out.Close()
+		return fmt.Errorf("writing metadata backup: %w", err)
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(home(s.BackupDir(), "bak.tmp"), home(s.BackupDir(), "bak")); err != nil {
+		return err
+	}
+
+	ks, err := lr.KeyStore()
+	if err != nil {
+		return fmt.Errorf("opening keystore: %w", err)
+	}
+	names, err := ks.List()
+	if err != nil {
+		return fmt.Errorf("listing keystore: %w", err)
+	}
+
+	keys := map[string]types.KeyInfo{}
+	for _, name := range names {
+		ki, err := ks.Get(name)
+		if err != nil {
+			return fmt.Errorf("reading key %s: %w", name, err)
+		}
+		keys[name] = ki
+	}
+
+	kb, err := json.Marshal(keys)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(home(s.BackupDir(), "keystore"), kb, 0600)
+}
+
+// restoreKeystore puts the keys saved by BackupRepo into the repo at path,
+// replacing any the restore generated
+func restoreKeystore(file, path string) error {
+	kb, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	keys := map[string]types.KeyInfo{}
+	if err := json.Unmarshal(kb, &keys); err != nil {
+		return fmt.Errorf("decoding keystore backup: %w", err)
+	}
+
+	r, err := repo.NewFS(path)
+	if err != nil {
+		return err
+	}
+	lr, err := r.Lock(repo.StorageMiner)
+	if err != nil {
+		return err
+	}
+	defer lr.Close()
+
+	ks, err := lr.KeyStore()
+	if err != nil {
+		return fmt.Errorf("opening keystore: %w", err)
+	}
+	for name, ki := range keys {
+		if err := ks.Delete(name); err != nil && !errors.Is(err, types.ErrKeyInfoNotFound) {
+			return fmt.Errorf("replacing key %s: %w", name, err)
+		}
+		if err := ks.Put(name, ki); err != nil {
+			return fmt.Errorf("restoring key %s: %w", name, err)
+		}
+	}
+	return nil
+}
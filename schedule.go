@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/dline"
+	lotusapi "github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/urfave/cli/v2"
+)
+
+// DeadlineTimes is when a deadline next opens, closes, gets challenged and
+// stops accepting fault declarations
+type DeadlineTimes struct {
+	Index       uint64
+	Open        time.Time
+	Close       time.Time
+	Challenge   time.Time
+	FaultCutoff time.Time
+}
+
+// MinerSchedule returns the next occurrence of every deadline of a miner, in
+// loc.
+func MinerSchedule(ctx context.Context, api lotusapi.FullNode, clock *EpochClock, maddr address.Address, loc *time.Location) ([]DeadlineTimes, error) {
+	cd, err := api.StateMinerProvingDeadline(ctx, maddr, types.EmptyTSK)
+	if err != nil {
+		return nil, fmt.Errorf("getting proving deadline: %w", err)
+	}
+
+	sched := make([]DeadlineTimes, 0, cd.WPoStPeriodDeadlines)
+	for i := uint64(0); i < cd.WPoStPeriodDeadlines; i++ {
+		di := dline.NewInfo(cd.PeriodStart, i, cd.CurrentEpoch, cd.WPoStPeriodDeadlines, cd.WPoStProvingPeriod, cd.WPoStChallengeWindow, cd.WPoStChallengeLookback, cd.FaultDeclarationCutoff).NextNotElapsed()
+
+		sched = append(sched, DeadlineTimes{
+			Index:       i,
+			Open:        clock.Time(di.Open).In(loc),
+			Close:       clock.Time(di.Close).In(loc),
+			Challenge:   clock.Time(di.Challenge).In(loc),
+			FaultCutoff: clock.Time(di.FaultCutoff).In(loc),
+		})
+	}
+	return sched, nil
+}
+
+func printScheduleTable(w io.Writer, sched []DeadlineTimes) error {
+	const layout = "2006-01-02 15:04 MST"
+
+	tw := tabwriter.NewWriter(w, 2, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "DEADLINE\tOPEN\tCLOSE\tCHALLENGE\tFAULT CUTOFF")
+	for _, d := range sched {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\n", d.Index, d.Open.Format(layout), d.Close.Format(layout), d.Challenge.Format(layout), d.FaultCutoff.Format(layout))
+	}
+	return tw.Flush()
+}
+
+// printScheduleICS writes the schedule as an iCalendar file with one daily
+// recurring event per deadline.
+func printScheduleICS(w io.Writer, maddr address.Address, sched []DeadlineTimes) error {
+	const layout = "20060102T150405Z"
+
+	period := time.Duration(0)
+	if len(sched) > 0 {
+		period = sched[0].Close.Sub(sched[0].Open) * time.Duration(len(sched))
+	}
+
+	var b strings.Builder
+	line := func(format string, a ...interface{}) {
+		fmt.Fprintf(&b, format+"\r\n", a...)
+	}
+
+	line("BEGIN:VCALENDAR")
+	line("VERSION:2.0")
+	line("PRODID:-//fil-miner-buyer//schedule//EN")
+	now := time.Now().UTC().Format(layout)
+	for _, d := range sched {
+		line("BEGIN:VEVENT")
+		line("UID:%s-deadline-%d@fil-miner-buyer", maddr, d.Index)
+		line("DTSTAMP:%s", now)
+		line("DTSTART:%s", d.Open.UTC().Format(layout))
+		line("DTEND:%s", d.Close.UTC().Format(layout))
+		// proving periods are a whole number of days on mainnet
+		if period > 0 && period%(24*time.Hour) == 0 {
+			line("RRULE:FREQ=DAILY;INTERVAL=%d", int(period/(24*time.Hour)))
+		}
+		line("SUMMARY:%s deadline %d", maddr, d.Index)
+		line("DESCRIPTION:challenge %s\\, fault cutoff %s", d.Challenge.UTC().Format(time.RFC3339), d.FaultCutoff.UTC().Format(time.RFC3339))
+		line("END:VEVENT")
+	}
+	line("END:VCALENDAR")
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+var scheduleCmd = &cli.Command{
+	Name:  "schedule",
+	Usage: "schedule <minerID> shows when each deadline of a miner opens",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "tz",
+			Usage: "IANA timezone to show times in",
+			Value: "Local",
+		},
+		&cli.StringFlag{
+			Name:  "output",
+			Usage: "output format: table, json or ics",
+			Value: "table",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		ctx := context.Background()
+
+		if c.Args().Len() < 1 {
+			return fmt.Errorf("please provide a miner ID")
+		}
+
+		maddr, err := address.NewFromString(c.Args().First())
+		if err != nil {
+			return fmt.Errorf("invalid miner ID: %w", err)
+		}
+
+		loc, err := time.LoadLocation(c.String("tz"))
+		if err != nil {
+			return fmt.Errorf("invalid timezone: %w", err)
+		}
+
+		threshold := os.Getenv("THRESHOLD")
+		svc := NewService(ctx, threshold)
+		defer svc.closer()
+
+		sched, err := MinerSchedule(ctx, svc.api, svc.clock, maddr, loc)
+		if err != nil {
+			return err
+		}
+
+		switch c.String("output") {
+		case "table":
+			return printScheduleTable(os.Stdout, sched)
+		case "json":
+			b, err := json.MarshalIndent(sched, "", "  ")
+			if err != nil {
+				return err
+			}
+			fmt.Println(string(b))
+			return nil
+		case "ics":
+			return printScheduleICS(os.Stdout, maddr, sched)
+		default:
+			return fmt.Errorf("unknown output format %q", c.String("output"))
+		}
+	},
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+// BackupTarget is somewhere backup archives are copied to, away from the
+// buying host
+type BackupTarget interface {
+	// Location is where name is stored on the target
+	Location(name string) string
+	// Put uploads the local file as name
+	Put(ctx context.Context, local, name string) error
+	// Get downloads name to the local file
+	Get(ctx context.Context, name, local string) error
+	String() string
+}
+
+// RemoteBackup records a backup archive uploaded to a target
+type RemoteBackup struct {
+	Location string
+	SHA256   string
+	Uploaded time.Time
+}
+
+// backupTargets are where every backup archive is uploaded to
+var backupTargets []BackupTarget
+
+var backupTargetFlag = &cli.StringSliceFlag{
+	Name:    "backup-target",
+	Usage:   "where to upload backups: a directory, s3://bucket/prefix or rsync://[user@]host/path; may be repeated",
+	EnvVars: []string{"BACKUP_TARGETS"},
+}
+
+// ParseBackupTarget parses a target given as a plain directory, a file://,
+// s3:// or rsync:// URL, or an rsync-style host:path destination. S3 targets
+// take the endpoint of S3-compatible stores such as MinIO from the endpoint
+// query parameter or S3_ENDPOINT.
+func ParseBackupTarget(s string) (BackupTarget, error) {
+	if strings.HasPrefix(s, "/") {
+		return dirTarget{dir: s}, nil
+	}
+
+	u, err := url.Parse(s)
+	if err != nil || u.Scheme == "" {
+		// user@host:path as rsync and scp take it
+		if i := strings.Index(s, ":"); i > 0 {
+			return rsyncTarget{dest: s}, nil
+		}
+		return nil, fmt.Errorf("invalid backup target %q", s)
+	}
+
+	switch u.Scheme {
+	case "file":
+		return dirTarget{dir: u.Path}, nil
+	case "s3":
+		endpoint := u.Query().Get("endpoint")
+		if endpoint == "" {
+			endpoint = os.Getenv("S3_ENDPOINT")
+		}
+		return s3Target{bucket: u.Host, prefix: strings.Trim(u.Path, "/"), endpoint: endpoint}, nil
+	case "rsync", "ssh", "sftp":
+		host := u.Host
+		if u.User != nil {
+			host = u.User.Username() + "@" + host
+		}
+		return rsyncTarget{dest: host + ":" + u.Path}, nil
+	default:
+		return nil, fmt.Errorf("unsupported backup target scheme %q", u.Scheme)
+	}
+}
+
+func setBackupTargets(c *cli.Context) error {
+	backupTargets = nil
+	for _, s := range c.StringSlice("backup-target") {
+		t, err := ParseBackupTarget(s)
+		if err != nil {
+			return err
+		}
+		backupTargets = append(backupTargets, t)
+	}
+	return nil
+}
+
+// dirTarget copies backups into a local directory, e.g. a mounted disk
+type dirTarget struct {
+	dir string
+}
+
+func (t dirTarget) Location(name string) string {
+	return filepath.Join(t.dir, filepath.FromSlash(name))
+}
+
+func (t dirTarget) Put(ctx context.Context, local, name string) error {
+	dst := t.Location(name)
+	if err := os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+		return err
+	}
+	if err := copyFile(local, dst+".tmp"); err != nil {
+		return err
+	}
+	return os.Rename(dst+".tmp", dst)
+}
+
+func (t dirTarget) Get(ctx context.Context, name, local string) error {
+	return copyFile(t.Location(name), local)
+}
+
+func (t dirTarget) String() string {
+	return "file://" + t.dir
+}
+
+func copyFile(src, dst string) error {
+	data, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(dst, data, 0600)
+}
+
+// s3Target uploads backups to an S3 bucket using the aws cli
+type s3Target struct {
+	bucket   string
+	prefix   string
+	endpoint string
+}
+
+func (t s3Target) Location(name string) string {
+	return "s3://" + path.Join(t.bucket, t.prefix, name)
+}
+
+func (t s3Target) run(ctx context.Context, args ...string) error {
+	if t.endpoint != "" {
+		args = append(args, "--endpoint-url", t.endpoint)
+	}
+
+	cmd := exec.CommandContext(ctx, "aws", args...)
+	out, err := cmd.CombinedOutput()
+	if debug {
+		os.Stderr.Write(out)
+	}
+	if err != nil {
+		return fmt.Errorf("error running aws %s: %w: %s", args[1], err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func (t s3Target) Put(ctx context.Context, local, name string) error {
+	return t.run(ctx, "s3", "cp", "--only-show-errors", local, t.Location(name))
+}
+
+func (t s3Target) Get(ctx context.Context, name, local string) error {
+	return t.run(ctx, "s3", "cp", "--only-show-errors", t.Location(name), local)
+}
+
+func (t s3Target) String() string {
+	return t.Location("")
+}
+
+// rsyncTarget copies backups to another host with rsync over ssh
+type rsyncTarget struct {
+	dest string
+}
+
+func (t rsyncTarget) Location(name string) string {
+	return strings.TrimSuffix(t.dest, "/") + "/" + name
+}
+
+func (t rsyncTarget) run(ctx context.Context, args ...string) error {
+	cmd := exec.CommandContext(ctx, "rsync", args...)
+	out, err := cmd.CombinedOutput()
+	if debug {
+		os.Stderr.Write(out)
+	}
+	if err != nil {
+		return fmt.Errorf("error running rsync: %w: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func (t rsyncTarget) Put(ctx context.Context, local, name string) error {
+	// --mkpath is too new to rely on, so create the parent directories by
+	// syncing an empty tree first
+	empty, err := ioutil.TempDir("", "rsync-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(empty)
+	if err := os.MkdirAll(filepath.Join(empty, filepath.FromSlash(path.Dir(name))), 0700); err != nil {
+		return err
+	}
+	if err := t.run(ctx, "-r", "--chmod=D700", empty+"/", t.Location("")); err != nil {
+		return err
+	}
+
+	return t.run(ctx, "--chmod=F600", local, t.Location(name))
+}
+
+func (t rsyncTarget) Get(ctx context.Context, name, local string) error {
+	return t.run(ctx, t.Location(name), local)
+}
+
+func (t rsyncTarget) String() string {
+	return "rsync://" + t.dest
+}
+
+// UploadBackup copies the miner's backup archive to every backup target that
+// does not have this version of it yet, and records the copies in the
+// inventory.
+func (s Miner) UploadBackup(ctx context.Context) error {
+	if len(backupTargets) == 0 {
+		return nil
+	}
+
+	local := s.ArchivePath()
+	if local == "" {
+		return fmt.Errorf("no backup archive of %s to upload", s.worker)
+	}
+	sum, err := fileSHA256(local)
+	if err != nil {
+		return err
+	}
+
+	inv, err := OpenInventory()
+	if err != nil {
+		return err
+	}
+	uploaded := map[string]bool{}
+	if rec, err := inv.Get(s.worker); err == nil {
+		for _, r := range rec.Remotes {
+			if r.SHA256 == sum {
+				uploaded[r.Location] = true
+			}
+		}
+	}
+
+	name := path.Join(s.worker, filepath.Base(local))
+
+	var failed []string
+	for _, t := range backupTargets {
+		loc := t.Location(name)
+		if uploaded[loc] {
+			continue
+		}
+		if err := t.Put(ctx, local, name); err != nil {
+			log.Errorf("uploading backup of %s to %s failed: %s", s.worker, t, err)
+			failed = append(failed, t.String())
+			continue
+		}
+		log.Infof("uploaded backup of %s to %s", s.worker, loc)
+
+		err = inv.Set(s.worker, func(rec *MinerRecord) {
+			rec.Remotes = append(rec.Remotes, RemoteBackup{
+				Location: loc,
+				SHA256:   sum,
+				Uploaded: time.Now(),
+			})
+		})
+		if err != nil {
+			return fmt.Errorf("recording upload in inventory failed: %w", err)
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("uploading backup to %s failed", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// FetchBackup downloads the latest archive of the miner that was uploaded to
+// one of the backup targets into its backup directory, checks it against the
+// checksum recorded at upload and returns its path.
+func (s Miner) FetchBackup(ctx context.Context) (string, error) {
+	inv, err := OpenInventory()
+	if err != nil {
+		return "", err
+	}
+	rec, err := inv.Get(s.worker)
+	if err != nil {
+		return "", err
+	}
+
+	remotes := append([]RemoteBackup(nil), rec.Remotes...)
+	sort.Slice(remotes, func(i, j int) bool {
+		return remotes[i].Uploaded.After(remotes[j].Uploaded)
+	})
+
+	for _, r := range remotes {
+		base := path.Base(filepath.ToSlash(r.Location))
+		name := path.Join(s.worker, base)
+		for _, t := range backupTargets {
+			if t.Location(name) != r.Location {
+				continue
+			}
+
+			if err := os.MkdirAll(s.BackupDir(), 0700); err != nil {
+				return "", err
+			}
+			local := home(s.BackupDir(), base)
+			if err := t.Get(ctx, name, local+".tmp"); err != nil {
+				log.Errorf("downloading backup of %s from %s failed: %s", s.worker, t, err)
+				continue
+			}
+			sum, err := fileSHA256(local + ".tmp")
+			if err != nil {
+				return "", err
+			}
+			if sum != r.SHA256 {
+				os.Remove(local + ".tmp")
+				log.Errorf("backup of %s from %s does not match the uploaded checksum", s.worker, t)
+				continue
+			}
+			if err := os.Rename(local+".tmp", local); err != nil {
+				return "", err
+			}
+			log.Infof("downloaded backup of %s from %s", s.worker, r.Location)
+			return local, nil
+		}
+	}
+	return "", fmt.Errorf("no backup of %s could be downloaded from the backup targets", s.worker)
+}
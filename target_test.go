@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mitchellh/go-homedir"
+)
+
+func setenv(t *testing.T, key, value string) {
+	old, ok := os.LookupEnv(key)
+	os.Setenv(key, value)
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(key, old)
+		} else {
+			os.Unsetenv(key)
+		}
+	})
+}
+
+func TestParseBackupTarget(t *testing.T) {
+	setenv(t, "S3_ENDPOINT", "")
+
+	tests := []struct {
+		in   string
+		want BackupTarget
+	}{
+		{"/mnt/backup", dirTarget{dir: "/mnt/backup"}},
+		{"file:///mnt/backup", dirTarget{dir: "/mnt/backup"}},
+		{"s3://bucket/some/prefix/", s3Target{bucket: "bucket", prefix: "some/prefix"}},
+		{"s3://bucket?endpoint=http://127.0.0.1:9000", s3Target{bucket: "bucket", endpoint: "http://127.0.0.1:9000"}},
+		{"rsync://user@host/srv/backup", rsyncTarget{dest: "user@host:/srv/backup"}},
+		{"user@host:backup", rsyncTarget{dest: "user@host:backup"}},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseBackupTarget(tt.in)
+		if err != nil {
+			t.Errorf("ParseBackupTarget(%q): %s", tt.in, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseBackupTarget(%q) = %#v, want %#v", tt.in, got, tt.want)
+		}
+	}
+
+	for _, in := range []string{"backup", "ftp://host/backup"} {
+		if _, err := ParseBackupTarget(in); err == nil {
+			t.Errorf("ParseBackupTarget(%q) did not fail", in)
+		}
+	}
+}
+
+// fakeAWS puts an aws script on PATH that serves s3 cp from a directory, the
+// way a local S3-compatible store would, and returns that directory
+func fakeAWS(t *testing.T) string {
+	bin := t.TempDir()
+	store := t.TempDir()
+
+	script := `#!/bin/sh
+# aws s3 cp --only-show-errors SRC DST [--endpoint-url URL]
+[ "$1 $2" = "s3 cp" ] || exit 2
+src=$4 dst=$5
+[ "$6" = "--endpoint-url" ] && [ "$7" = "$FAKE_S3_ENDPOINT" ] || [ -z "$6" ] || exit 3
+case $src in s3://*) src="$FAKE_S3_STORE/${src#s3://}" ;; esac
+case $dst in s3://*) dst="$FAKE_S3_STORE/${dst#s3://}"; mkdir -p "$(dirname "$dst")" ;; esac
+exec cp "$src" "$dst"
+`
+	if err := ioutil.WriteFile(filepath.Join(bin, "aws"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	setenv(t, "PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	setenv(t, "FAKE_S3_STORE", store)
+	setenv(t, "FAKE_S3_ENDPOINT", "http://127.0.0.1:9000")
+	return store
+}
+
+func testPutGet(t *testing.T, target BackupTarget) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	local := filepath.Join(dir, "backup.tar.gz")
+	if err := ioutil.WriteFile(local, []byte("archive"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := target.Put(ctx, local, "f3worker/backup.tar.gz"); err != nil {
+		t.Fatalf("Put: %s", err)
+	}
+	back := filepath.Join(dir, "back.tar.gz")
+	if err := target.Get(ctx, "f3worker/backup.tar.gz", back); err != nil {
+		t.Fatalf("Get: %s", err)
+	}
+
+	b, err := ioutil.ReadFile(back)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "archive" {
+		t.Errorf("got %q back from %s, want %q", b, target, "archive")
+	}
+}
+
+func TestDirTarget(t *testing.T) {
+	testPutGet(t, dirTarget{dir: t.TempDir()})
+}
+
+func TestS3Target(t *testing.T) {
+	store := fakeAWS(t)
+
+	target, err := ParseBackupTarget("s3://bucket/prefix?endpoint=http://127.0.0.1:9000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testPutGet(t, target)
+
+	if _, err := os.Stat(filepath.Join(store, "bucket/prefix/f3worker/backup.tar.gz")); err != nil {
+		t.Errorf("archive not stored under the bucket and prefix: %s", err)
+	}
+	if loc := target.Location("f3worker/backup.tar.gz"); loc != "s3://bucket/prefix/f3worker/backup.tar.gz" {
+		t.Errorf("Location = %s", loc)
+	}
+}
+
+func TestFetchBackup(t *testing.T) {
+	homedir.DisableCache = true
+	t.Cleanup(func() { homedir.DisableCache = false })
+	setenv(t, "HOME", t.TempDir())
+	setenv(t, "LOTUS_BACKUP_DIR", t.TempDir())
+
+	old := backupTargets
+	t.Cleanup(func() { backupTargets = old })
+	remote := dirTarget{dir: t.TempDir()}
+	backupTargets = []BackupTarget{remote}
+
+	m := NewMiner("f3owner", "f3worker", "")
+	name := "backup-20210901T000000Z.tar.gz"
+
+	src := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(src, []byte("archive"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.Put(context.Background(), src, "f3worker/"+name); err != nil {
+		t.Fatal(err)
+	}
+	sum, err := fileSHA256(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inv, err := OpenInventory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = inv.Set("f3worker", func(rec *MinerRecord) {
+		rec.Remotes = []RemoteBackup{
+			{Location: remote.Location("f3worker/" + name), SHA256: sum, Uploaded: time.Now()},
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path, err := m.FetchBackup(context.Background())
+	if err != nil {
+		t.Fatalf("FetchBackup: %s", err)
+	}
+	if path != home(m.BackupDir(), name) {
+		t.Errorf("fetched to %s, want %s", path, home(m.BackupDir(), name))
+	}
+
+	// a copy that changed since the upload is not trusted
+	if err := ioutil.WriteFile(remote.Location("f3worker/"+name), []byte("tampered"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(path)
+	if _, err := m.FetchBackup(context.Background()); err == nil {
+		t.Error("FetchBackup accepted an archive that does not match its checksum")
+	}
+}
@@ -2,41 +2,11 @@ package main
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
-	"time"
-
-	"github.com/filecoin-project/go-state-types/abi"
-	"github.com/filecoin-project/lotus/build"
-	"github.com/hako/durafmt"
+	"path/filepath"
 )
 
-var genesisUnixTimestamp = time.Unix(1598306400, 0)
-
-func EpochTimeStr(curr, e abi.ChainEpoch) string {
-	switch {
-	case curr > e:
-		return fmt.Sprintf("%d (%s ago)", e, durafmt.Parse(time.Second*time.Duration(int64(build.BlockDelaySecs)*int64(curr-e))).LimitFirstN(2))
-	case curr == e:
-		return fmt.Sprintf("%d (now)", e)
-	case curr < e:
-		return fmt.Sprintf("%d (in %s)", e, durafmt.Parse(time.Second*time.Duration(int64(build.BlockDelaySecs)*int64(e-curr))).LimitFirstN(2))
-	}
-
-	panic("math broke")
-}
-
-func EpochTime(curr, e abi.ChainEpoch) time.Duration {
-	return durafmt.Parse(time.Second * time.Duration(int64(build.BlockDelaySecs)*int64(curr-e))).LimitFirstN(2).Duration()
-}
-
-func EpochTimestamp(e abi.ChainEpoch) time.Time {
-	return genesisUnixTimestamp.Add(DurationSinceGenesis(e))
-}
-
-func DurationSinceGenesis(e abi.ChainEpoch) time.Duration {
-	return durafmt.Parse(time.Second * time.Duration(int64(build.BlockDelaySecs)*int64(e))).LimitFirstN(2).Duration()
-}
-
 func AppendFile(file string, data []byte) error {
 	f, err := os.OpenFile(file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
@@ -49,6 +19,31 @@ func AppendFile(file string, data []byte) error {
 	return nil
 }
 
+// CopyDir recursively copies the directory src to dst, keeping file modes
+func CopyDir(src, dst string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		if info.IsDir() {
+			return os.MkdirAll(target, info.Mode().Perm())
+		}
+
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(target, data, info.Mode().Perm())
+	})
+}
+
 func home(home, path string) string {
 	return fmt.Sprintf("%s/%s", home, path)
 }
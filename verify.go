@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/filecoin-project/lotus/chain/wallet"
+	"github.com/urfave/cli/v2"
+)
+
+// VerifyCheck is the outcome of one check of a test-restore
+type VerifyCheck struct {
+	Name   string
+	Err    error
+	Detail string
+}
+
+// readKeyFile decodes a key written by `lotus wallet export`
+func readKeyFile(path string) (*types.KeyInfo, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	kb, err := hex.DecodeString(strings.TrimSpace(string(content)))
+	if err != nil {
+		return nil, fmt.Errorf("decoding key: %w", err)
+	}
+
+	var ki types.KeyInfo
+	if err := json.Unmarshal(kb, &ki); err != nil {
+		return nil, fmt.Errorf("decoding key info: %w", err)
+	}
+	return &ki, nil
+}
+
+// importKeyFile imports a key written by `lotus wallet export` into a
+// throwaway in-memory wallet, as restoring it into a node would, and returns
+// the address it was imported as
+func importKeyFile(ctx context.Context, path string) (address.Address, error) {
+	ki, err := readKeyFile(path)
+	if err != nil {
+		return address.Undef, err
+	}
+
+	w, err := wallet.NewWallet(wallet.NewMemKeyStore())
+	if err != nil {
+		return address.Undef, err
+	}
+	addr, err := w.WalletImport(ctx, ki)
+	if err != nil {
+		return address.Undef, fmt.Errorf("importing key: %w", err)
+	}
+	return addr, nil
+}
+
+// VerifyBackup restores the miner's backup into a temporary repo and checks
+// the repo's miner address against the inventory and the chain, and that the
+// worker key imports as the miner's worker on chain. It stops at the first
+// check that cannot be built on.
+func (s *Service) VerifyBackup(ctx context.Context) []VerifyCheck {
+	var checks []VerifyCheck
+	check := func(name string, err error, detail string) bool {
+		checks = append(checks, VerifyCheck{name, err, detail})
+		return err == nil
+	}
+
+	dir, cleanup, err := s.OpenBackup(ctx)
+	if !check("open", err, s.BackupDir()) {
+		return checks
+	}
+	defer cleanup()
+
+	tmp, err := ioutil.TempDir("", "lotusminer-verify-")
+	if err != nil {
+		check("restore", err, "")
+		return checks
+	}
+	defer os.RemoveAll(tmp)
+
+	// restore into a repo that does not exist yet, as lotus-miner expects
+	path := home(tmp, "lotusminer")
+	if !check("restore", s.restoreFrom(ctx, dir, path), path) {
+		return checks
+	}
+
+	maddr, err := readRepoMinerAddress(ctx, path)
+	if !check("metadata", err, maddr.String()) {
+		return checks
+	}
+
+	if inv, err := OpenInventory(); err != nil {
+		check("inventory", err, "")
+	} else if rec, err := inv.Get(s.worker); err != nil {
+		check("inventory", nil, "not recorded")
+	} else if rec.Miner != "" && rec.Miner != maddr.String() {
+		check("inventory", fmt.Errorf("inventory has miner %s", rec.Miner), maddr.String())
+	} else {
+		check("inventory", nil, rec.Miner)
+	}
+
+	info, err := GetChainMinerInfo(ctx, s.api, maddr)
+	if !check("chain", err, maddr.String()) {
+		return checks
+	}
+	if info.Worker != s.worker {
+		check("chain", fmt.Errorf("worker on chain is %s", info.Worker), s.worker)
+	} else {
+		check("chain", nil, "worker "+info.Worker)
+	}
+
+	kaddr, err := importKeyFile(ctx, home(dir, "key"))
+	switch {
+	case err != nil:
+		check("worker key", err, "")
+	case kaddr.String() != info.Worker:
+		check("worker key", fmt.Errorf("key imports as %s, not the worker %s", kaddr, info.Worker), "")
+	default:
+		check("worker key", nil, kaddr.String())
+	}
+
+	return checks
+}
+
+var backupVerifyCmd = &cli.Command{
+	Name:  "verify",
+	Usage: "verify <worker|minerID> test-restores a backup and checks it against the inventory and chain",
+	Action: func(c *cli.Context) error {
+		ctx := context.Background()
+
+		if c.Args().Len() < 1 {
+			return fmt.Errorf("please provide a worker address or miner ID")
+		}
+
+		threshold := os.Getenv("THRESHOLD")
+		svc := NewService(ctx, threshold)
+		defer svc.closer()
+
+		worker, err := resolveWorker(c.Args().First())
+		if err != nil {
+			return err
+		}
+		svc.worker = worker
+
+		checks := svc.VerifyBackup(ctx)
+
+		var failed int
+		tw := tabwriter.NewWriter(os.Stdout, 2, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "CHECK\tRESULT\tDETAIL")
+		for _, ch := range checks {
+			result, detail := "ok", ch.Detail
+			if ch.Err != nil {
+				failed++
+				result, detail = "FAILED", ch.Err.Error()
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", ch.Name, result, detail)
+		}
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+
+		if failed > 0 {
+			return fmt.Errorf("backup of %s failed %d checks", svc.worker, failed)
+		}
+		return nil
+	},
+}
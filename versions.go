@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+// BackupVersion is one backup archive of a miner
+type BackupVersion struct {
+	Path      string
+	Time      time.Time
+	Size      int64
+	Encrypted bool
+}
+
+// parseArchiveName reports whether name is a backup archive and the time in
+// its name, if any
+func parseArchiveName(name string) (time.Time, bool, bool) {
+	encrypted := strings.HasSuffix(name, ".age")
+	base := strings.TrimSuffix(name, ".age")
+	if !strings.HasPrefix(base, archivePrefix) || !strings.HasSuffix(base, archiveExt) {
+		return time.Time{}, false, false
+	}
+
+	stamp := strings.TrimPrefix(strings.TrimSuffix(base, archiveExt), archivePrefix)
+	if stamp == "" {
+		return time.Time{}, encrypted, true
+	}
+	t, err := time.Parse(archiveTimeLayout, strings.TrimPrefix(stamp, "-"))
+	if err != nil {
+		return time.Time{}, false, false
+	}
+	return t, encrypted, true
+}
+
+// BackupVersions lists the backup archives of the miner, newest first
+func (s Miner) BackupVersions() ([]BackupVersion, error) {
+	entries, err := ioutil.ReadDir(s.BackupDir())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var versions []BackupVersion
+	for _, e := range entries {
+		t, encrypted, ok := parseArchiveName(e.Name())
+		if !ok || !e.Mode().IsRegular() {
+			continue
+		}
+		// archives from before versioning carry their time in the file
+		if t.IsZero() {
+			t = e.ModTime().UTC()
+		}
+
+		versions = append(versions, BackupVersion{
+			Path:      home(s.BackupDir(), e.Name()),
+			Time:      t,
+			Size:      e.Size(),
+			Encrypted: encrypted,
+		})
+	}
+
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].Time.After(versions[j].Time)
+	})
+	return versions, nil
+}
+
+// RetentionPolicy decides which backup versions to keep: the newest Last
+// versions, plus the newest version of each of the newest Monthly months
+type RetentionPolicy struct {
+	Last    int
+	Monthly int
+}
+
+// Keep returns which of versions, ordered newest first, the policy keeps
+func (p RetentionPolicy) Keep(versions []BackupVersion) []bool {
+	keep := make([]bool, len(versions))
+	months := map[string]bool{}
+	for i, v := range versions {
+		if i < p.Last {
+			keep[i] = true
+		}
+
+		month := v.Time.Format("2006-01")
+		if !months[month] && len(months) < p.Monthly {
+			months[month] = true
+			keep[i] = true
+		}
+	}
+	return keep
+}
+
+// PruneBackups removes the miner's local backup versions that the policy
+// does not keep and returns them. Copies on backup targets are left alone.
+func (s Miner) PruneBackups(p RetentionPolicy, dryRun bool) ([]BackupVersion, error) {
+	versions, err := s.BackupVersions()
+	if err != nil {
+		return nil, err
+	}
+
+	var pruned []BackupVersion
+	for i, keep := range p.Keep(versions) {
+		if keep {
+			continue
+		}
+		if !dryRun {
+			if err := os.Remove(versions[i].Path); err != nil {
+				return pruned, err
+			}
+		}
+		pruned = append(pruned, versions[i])
+	}
+	return pruned, nil
+}
+
+var backupListCmd = &cli.Command{
+	Name:  "list",
+	Usage: "list <worker> shows every backup version of a miner",
+	Action: func(c *cli.Context) error {
+		if c.Args().Len() < 1 {
+			return fmt.Errorf("please provide a worker address")
+		}
+
+		m := NewMiner("", c.Args().First(), "")
+		versions, err := m.BackupVersions()
+		if err != nil {
+			return err
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 2, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "TIME\tSIZE\tSHA256\tENCRYPTED\tPATH")
+		for _, v := range versions {
+			sum, err := fileSHA256(v.Path)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(tw, "%s\t%d\t%s\t%t\t%s\n", v.Time.Format(time.RFC3339), v.Size, sum, v.Encrypted, v.Path)
+		}
+		return tw.Flush()
+	},
+}
+
+var backupPruneCmd = &cli.Command{
+	Name:  "prune",
+	Usage: "prune [worker...] removes local backup versions outside the retention policy, for every miner if none are given",
+	Flags: []cli.Flag{
+		&cli.IntFlag{
+			Name:    "keep-last",
+			Usage:   "number of newest versions to keep",
+			EnvVars: []string{"BACKUP_KEEP_LAST"},
+			Value:   5,
+		},
+		&cli.IntFlag{
+			Name:    "keep-monthly",
+			Usage:   "number of months to keep the newest version of",
+			EnvVars: []string{"BACKUP_KEEP_MONTHLY"},
+			Value:   12,
+		},
+		&cli.BoolFlag{
+			Name:  "dry-run",
+			Usage: "only show what would be removed",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		policy := RetentionPolicy{
+			Last:    c.Int("keep-last"),
+			Monthly: c.Int("keep-monthly"),
+		}
+		if policy.Last < 1 {
+			return fmt.Errorf("--keep-last must be at least 1")
+		}
+
+		workers := c.Args().Slice()
+		if len(workers) == 0 {
+			entries, err := ioutil.ReadDir(NewMiner("", "", "").BackupRoot())
+			if err != nil {
+				return err
+			}
+			for _, e := range entries {
+				if e.IsDir() {
+					workers = append(workers, e.Name())
+				}
+			}
+		}
+
+		for _, w := range workers {
+			pruned, err := NewMiner("", w, "").PruneBackups(policy, c.Bool("dry-run"))
+			for _, v := range pruned {
+				fmt.Println(v.Path)
+			}
+			if err != nil {
+				return fmt.Errorf("pruning backups of %s failed: %w", w, err)
+			}
+		}
+		return nil
+	},
+}
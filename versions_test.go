@@ -0,0 +1,95 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetentionPolicyKeep(t *testing.T) {
+	// versions newest first, given as yyyy-mm-dd
+	versions := func(days ...string) []BackupVersion {
+		var vs []BackupVersion
+		for _, d := range days {
+			tm, err := time.Parse("2006-01-02", d)
+			if err != nil {
+				t.Fatal(err)
+			}
+			vs = append(vs, BackupVersion{Path: d, Time: tm})
+		}
+		return vs
+	}
+
+	tests := []struct {
+		name     string
+		policy   RetentionPolicy
+		versions []BackupVersion
+		want     string
+	}{
+		{
+			"no versions",
+			RetentionPolicy{Last: 3, Monthly: 12},
+			nil,
+			"",
+		},
+		{
+			"fewer than last",
+			RetentionPolicy{Last: 5, Monthly: 0},
+			versions("2021-09-03", "2021-09-02", "2021-09-01"),
+			"yyy",
+		},
+		{
+			"last only",
+			RetentionPolicy{Last: 2, Monthly: 0},
+			versions("2021-09-03", "2021-09-02", "2021-08-30", "2021-07-01"),
+			"yynn",
+		},
+		{
+			"monthly only",
+			RetentionPolicy{Last: 0, Monthly: 2},
+			versions("2021-09-03", "2021-09-02", "2021-08-30", "2021-08-01", "2021-07-01"),
+			"ynynn",
+		},
+		{
+			"monthly picks the newest of each month",
+			RetentionPolicy{Last: 1, Monthly: 3},
+			versions("2021-09-03", "2021-09-02", "2021-08-30", "2021-08-01", "2021-07-15", "2021-07-01", "2021-06-01"),
+			"ynynynn",
+		},
+		{
+			"last overlaps monthly",
+			RetentionPolicy{Last: 3, Monthly: 2},
+			versions("2021-09-03", "2021-09-02", "2021-08-30", "2021-08-01", "2021-07-01"),
+			"yyynn",
+		},
+		{
+			"last reaches into an older month",
+			RetentionPolicy{Last: 4, Monthly: 1},
+			versions("2021-09-03", "2021-08-30", "2021-07-01", "2021-06-01", "2021-05-01"),
+			"yyyyn",
+		},
+		{
+			"months skipped by backups",
+			RetentionPolicy{Last: 1, Monthly: 3},
+			versions("2021-09-03", "2021-05-01", "2021-01-01", "2020-12-01"),
+			"yyyn",
+		},
+		{
+			"same month in different years",
+			RetentionPolicy{Last: 0, Monthly: 2},
+			versions("2021-09-03", "2020-09-03"),
+			"yy",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+			for _, k := range tt.policy.Keep(tt.versions) {
+				got += map[bool]string{true: "y", false: "n"}[k]
+			}
+			if got != tt.want {
+				t.Errorf("Keep(%+v) = %s, want %s", tt.policy, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/lotus/chain/store"
+	"github.com/filecoin-project/lotus/chain/types"
+)
+
+// buyQuota limits how many miners get bought within a rolling window and
+// within a calendar day. A zero limit means no limit.
+type buyQuota struct {
+	window    time.Duration
+	perWindow int
+	perDay    int
+
+	bought []time.Time
+}
+
+// Allow reports whether another miner may be bought at now.
+func (q *buyQuota) Allow(now time.Time) bool {
+	return q.Remaining(now) != 0
+}
+
+// Remaining returns how many more miners may be bought at now, or -1 if there
+// is no limit.
+func (q *buyQuota) Remaining(now time.Time) int {
+	q.prune(now)
+
+	remaining := -1
+	limit := func(max, n int) {
+		left := max - n
+		if left < 0 {
+			left = 0
+		}
+		if remaining < 0 || left < remaining {
+			remaining = left
+		}
+	}
+
+	if q.perWindow > 0 {
+		var n int
+		for _, t := range q.bought {
+			if now.Sub(t) < q.window {
+				n++
+			}
+		}
+		limit(q.perWindow, n)
+	}
+
+	if q.perDay > 0 {
+		var n int
+		y, m, d := now.Date()
+		for _, t := range q.bought {
+			ty, tm, td := t.Date()
+			if ty == y && tm == m && td == d {
+				n++
+			}
+		}
+		limit(q.perDay, n)
+	}
+
+	return remaining
+}
+
+// Record counts a miner bought at now against the quota.
+func (q *buyQuota) Record(now time.Time) {
+	q.bought = append(q.bought, now)
+}
+
+// prune forgets purchases that can no longer count against either limit.
+func (q *buyQuota) prune(now time.Time) {
+	keep := 24 * time.Hour
+	if q.window > keep {
+		keep = q.window
+	}
+
+	var i int
+	for i < len(q.bought) && now.Sub(q.bought[i]) >= keep {
+		i++
+	}
+	q.bought = q.bought[i:]
+}
+
+// Watch checks the gas price on every new tipset and buys count miners
+// whenever it is below the threshold and the quota allows it. It returns once
+// ctx is cancelled; a purchase that is already in progress is allowed to
+// finish.
+func (s *Service) Watch(ctx context.Context, q *buyQuota, count int) error {
+	notifs, err := s.api.ChainNotify(ctx)
+	if err != nil {
+		return fmt.Errorf("subscribing to chain head changes failed: %w", err)
+	}
+
+	log.Info("watching chain for low gas")
+	for {
+		select {
+		case <-ctx.Done():
+			log.Info("shutting down watcher")
+			return nil
+		case changes, ok := <-notifs:
+			if !ok {
+				if ctx.Err() != nil {
+					return nil
+				}
+				return fmt.Errorf("chain notify channel closed")
+			}
+
+			var head *types.TipSet
+			for _, hc := range changes {
+				if hc.Type == store.HCApply || hc.Type == store.HCCurrent {
+					head = hc.Val
+				}
+			}
+			if head == nil {
+				continue
+			}
+
+			// keep the history current while watching so the percentile
+			// trigger does not depend on a separate recorder
+			if s.gasHistory != nil {
+				sample, err := s.SampleGas(ctx, head)
+				if err != nil {
+					log.Errorf("sampling gas failed: %s", err)
+				} else if err := s.gasHistory.Put(sample); err != nil {
+					log.Errorf("recording gas failed: %s", err)
+				}
+			}
+
+			now := time.Now()
+			if !q.Allow(now) {
+				log.Debugf("quota reached; skipping epoch %d", head.Height())
+				continue
+			}
+
+			if !s.IsGasPriceBelowThreshold(ctx) {
+				continue
+			}
+
+			if s.predict {
+				zd, err := s.PredictZerothDeadline(ctx, address.Undef)
+				if err != nil {
+					log.Errorf("predicting zeroth deadline failed: %s", err)
+					continue
+				}
+				if !s.inWindow(zd) {
+					log.Infof("predicted zeroth deadline hour %d is outside of the trading window", zd.Hour())
+					continue
+				}
+			}
+
+			n := count
+			if left := q.Remaining(now); left >= 0 && left < n {
+				n = left
+			}
+
+			log.Infof("gas below threshold at epoch %d; buying %d miner(s)", head.Height(), n)
+			// the purchase runs on its own context so that a shutdown
+			// request does not abandon a miner that has already been paid for
+			for _, p := range s.BuyMany(context.Background(), n) {
+				// a pushed CreateMiner is paid for whether or not the
+				// miner could be finished afterwards
+				if p.msg.Defined() {
+					q.Record(now)
+				}
+				if p.err != nil {
+					log.Errorf("buying miner failed: %s", p.err)
+				}
+			}
+		}
+	}
+}
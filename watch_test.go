@@ -0,0 +1,85 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBuyQuotaRemaining(t *testing.T) {
+	day := time.Date(2021, 9, 1, 0, 0, 0, 0, time.UTC)
+	at := func(hour, min int) time.Time {
+		return day.Add(time.Duration(hour)*time.Hour + time.Duration(min)*time.Minute)
+	}
+
+	tests := []struct {
+		name      string
+		window    time.Duration
+		perWindow int
+		perDay    int
+		bought    []time.Time
+		now       time.Time
+		want      int
+	}{
+		{"no limits", time.Hour, 0, 0, []time.Time{at(9, 0), at(9, 1)}, at(9, 2), -1},
+		{"window empty", time.Hour, 2, 0, nil, at(9, 0), 2},
+		{"window partly used", time.Hour, 2, 0, []time.Time{at(9, 0)}, at(9, 30), 1},
+		{"window full", time.Hour, 2, 0, []time.Time{at(9, 0), at(9, 10)}, at(9, 59), 0},
+		{"window over", time.Hour, 2, 0, []time.Time{at(9, 0), at(9, 10), at(9, 20)}, at(9, 30), 0},
+		{"first purchase leaves the window", time.Hour, 2, 0, []time.Time{at(9, 0), at(9, 10)}, at(10, 0), 1},
+		{"window boundary is exclusive", time.Hour, 1, 0, []time.Time{at(9, 0)}, at(9, 59).Add(59 * time.Second), 0},
+		{"day partly used", 0, 0, 3, []time.Time{at(1, 0), at(12, 0)}, at(23, 59), 1},
+		{"day full", 0, 0, 2, []time.Time{at(1, 0), at(12, 0)}, at(23, 59), 0},
+		{"next day", 0, 0, 2, []time.Time{at(1, 0), at(23, 59)}, at(24, 0), 2},
+		{"window tighter than day", time.Hour, 1, 5, []time.Time{at(9, 0)}, at(9, 30), 0},
+		{"day tighter than window", 2 * time.Hour, 3, 2, []time.Time{at(8, 0), at(9, 0)}, at(9, 30), 0},
+		{"window spans midnight", 2 * time.Hour, 2, 5, []time.Time{at(23, 0), at(23, 30)}, at(24, 30), 0},
+		{"day spans window", 2 * time.Hour, 2, 2, []time.Time{at(8, 0)}, at(23, 0), 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := &buyQuota{window: tt.window, perWindow: tt.perWindow, perDay: tt.perDay}
+			for _, b := range tt.bought {
+				q.Record(b)
+			}
+
+			if got := q.Remaining(tt.now); got != tt.want {
+				t.Errorf("Remaining = %d, want %d", got, tt.want)
+			}
+			if got := q.Allow(tt.now); got != (tt.want != 0) {
+				t.Errorf("Allow = %v, want %v", got, tt.want != 0)
+			}
+		})
+	}
+}
+
+func TestBuyQuotaPrune(t *testing.T) {
+	start := time.Date(2021, 9, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name   string
+		window time.Duration
+		now    time.Duration
+		want   int
+	}{
+		{"within a day", time.Hour, 23 * time.Hour, 3},
+		{"first a day old", time.Hour, 24 * time.Hour, 2},
+		{"all a day old", time.Hour, 26 * time.Hour, 0},
+		{"kept for a longer window", 48 * time.Hour, 47 * time.Hour, 3},
+		{"longer window passed", 48 * time.Hour, 49 * time.Hour, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := &buyQuota{window: tt.window, perWindow: 10}
+			for i := 0; i < 3; i++ {
+				q.Record(start.Add(time.Duration(i) * time.Hour))
+			}
+
+			q.prune(start.Add(tt.now))
+			if len(q.bought) != tt.want {
+				t.Errorf("kept %d purchases, want %d", len(q.bought), tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+// Window is a time of day range in a timezone, from Start up to but not
+// including Finish, both in minutes since midnight. A Finish on the hour
+// includes that whole hour, so 9:00AM-5:00PM runs until 5:59PM as hour-based
+// windows always did. A window whose Finish is before its Start wraps past
+// midnight.
+type Window struct {
+	Start  int
+	Finish int
+	Loc    *time.Location
+}
+
+// Windows is a set of windows; a time is in it when it is in any of them
+type Windows []Window
+
+var clockLayouts = []string{time.Kitchen, "3:04 PM", "15:04", "3PM", "15"}
+
+// parseClock parses a time of day such as 10:30PM, 22:30 or just the hour,
+// 10PM or 22, into minutes since midnight
+func parseClock(s string) (int, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	for _, layout := range clockLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t.Hour()*60 + t.Minute(), nil
+		}
+	}
+	return 0, fmt.Errorf("invalid time of day %q, use e.g. 10:30PM, 22:30 or 22", s)
+}
+
+// NewWindow builds a window from start and finish times of day in the named
+// IANA timezone
+func NewWindow(start, finish, tz string) (Window, error) {
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		return Window{}, fmt.Errorf("invalid timezone %q: %w", tz, err)
+	}
+
+	w := Window{Loc: loc}
+	if w.Start, err = parseClock(start); err != nil {
+		return Window{}, err
+	}
+	if w.Finish, err = parseClock(finish); err != nil {
+		return Window{}, err
+	}
+	if w.Start == w.Finish {
+		return Window{}, fmt.Errorf("window %s-%s is empty", start, finish)
+	}
+	return w, nil
+}
+
+// ParseWindow parses a window written as START-FINISH, optionally followed by
+// @TIMEZONE, e.g. 10:00PM-6:00AM@Asia/Tokyo. Windows without a timezone are
+// in tz.
+func ParseWindow(s, tz string) (Window, error) {
+	if i := strings.LastIndex(s, "@"); i >= 0 {
+		s, tz = s[:i], s[i+1:]
+	}
+
+	parts := strings.Split(s, "-")
+	if len(parts) != 2 {
+		return Window{}, fmt.Errorf("invalid window %q, use START-FINISH[@TIMEZONE]", s)
+	}
+	return NewWindow(parts[0], parts[1], tz)
+}
+
+// end is the first minute after the window
+func (w Window) end() int {
+	if w.Finish%60 == 0 {
+		return w.Finish + 60
+	}
+	return w.Finish
+}
+
+// Contains reports whether t falls in the window
+func (w Window) Contains(t time.Time) bool {
+	t = t.In(w.Loc)
+	m := t.Hour()*60 + t.Minute()
+	if w.Start < w.Finish {
+		return w.Start <= m && m < w.end()
+	}
+	return m >= w.Start || m < w.end()
+}
+
+func (w Window) String() string {
+	return fmt.Sprintf("%02d:%02d-%02d:%02d@%s", w.Start/60, w.Start%60, w.Finish/60, w.Finish%60, w.Loc)
+}
+
+// Contains reports whether t falls in any of the windows
+func (ws Windows) Contains(t time.Time) bool {
+	for _, w := range ws {
+		if w.Contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	windowStartFlag = &cli.StringFlag{
+		Name:  "start",
+		Usage: "start of the trading window, e.g. 9:00AM or 09:00",
+	}
+	windowFinishFlag = &cli.StringFlag{
+		Name:  "finish",
+		Usage: "end of the trading window, e.g. 5:00PM or 17:00, a whole hour includes that hour; before --start to wrap past midnight",
+	}
+	windowTZFlag = &cli.StringFlag{
+		Name:    "tz",
+		Usage:   "IANA timezone of the trading windows",
+		EnvVars: []string{"TRADE_TZ"},
+		Value:   "Local",
+	}
+)
+
+// windowFlags take the trading windows from the command line or, failing
+// that, from TRADE_WINDOWS and so the profile
+var windowFlags = []cli.Flag{
+	windowStartFlag,
+	windowFinishFlag,
+	windowTZFlag,
+	&cli.StringSliceFlag{
+		Name:    "trade-window",
+		Usage:   "trading window as START-FINISH[@TIMEZONE], e.g. 10:00PM-6:00AM@Asia/Tokyo; may be repeated",
+		EnvVars: []string{"TRADE_WINDOWS"},
+	},
+}
+
+// filterWindowFlags take trading windows from the command line only, for
+// commands that change what they print when windows are given
+var filterWindowFlags = []cli.Flag{
+	windowStartFlag,
+	windowFinishFlag,
+	windowTZFlag,
+	&cli.StringSliceFlag{
+		Name:  "trade-window",
+		Usage: "only list miners whose zeroth deadline falls in this window, as START-FINISH[@TIMEZONE]; may be repeated",
+	},
+}
+
+// parseWindowFlags builds the trading windows from --start/--finish and
+// --trade-window. It returns no windows when none are given.
+func parseWindowFlags(c *cli.Context) (Windows, error) {
+	var ws Windows
+
+	if c.IsSet("start") || c.IsSet("finish") {
+		if c.String("start") == "" || c.String("finish") == "" {
+			return nil, fmt.Errorf("--start and --finish must be given together")
+		}
+		w, err := NewWindow(c.String("start"), c.String("finish"), c.String("tz"))
+		if err != nil {
+			return nil, err
+		}
+		ws = append(ws, w)
+	}
+
+	for _, s := range c.StringSlice("trade-window") {
+		w, err := ParseWindow(s, c.String("tz"))
+		if err != nil {
+			return nil, err
+		}
+		ws = append(ws, w)
+	}
+
+	return ws, nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseWindow(t *testing.T) {
+	tests := []struct {
+		in     string
+		tz     string
+		start  int
+		finish int
+		loc    string
+	}{
+		{"9:00AM-5:00PM", "UTC", 9 * 60, 17 * 60, "UTC"},
+		{"9:00 AM-5:30 PM", "UTC", 9 * 60, 17*60 + 30, "UTC"},
+		{"09:15-17:45", "UTC", 9*60 + 15, 17*60 + 45, "UTC"},
+		{"9-17", "UTC", 9 * 60, 17 * 60, "UTC"},
+		{"10pm-6am", "UTC", 22 * 60, 6 * 60, "UTC"},
+		{"10:00PM-6:00AM@Asia/Tokyo", "UTC", 22 * 60, 6 * 60, "Asia/Tokyo"},
+		{"9-17", "Europe/Berlin", 9 * 60, 17 * 60, "Europe/Berlin"},
+	}
+
+	for _, tt := range tests {
+		w, err := ParseWindow(tt.in, tt.tz)
+		if err != nil {
+			t.Errorf("ParseWindow(%q): %s", tt.in, err)
+			continue
+		}
+		if w.Start != tt.start || w.Finish != tt.finish || w.Loc.String() != tt.loc {
+			t.Errorf("ParseWindow(%q) = %s, want %d-%d@%s", tt.in, w, tt.start, tt.finish, tt.loc)
+		}
+	}
+}
+
+func TestParseWindowErrors(t *testing.T) {
+	for _, in := range []string{
+		"9:00AM",
+		"9-12-17",
+		"25:00-26:00",
+		"noon-17",
+		"9-17@Nowhere/Nothing",
+		"9:00-9:00",
+	} {
+		if w, err := ParseWindow(in, "UTC"); err == nil {
+			t.Errorf("ParseWindow(%q) = %s, want an error", in, w)
+		}
+	}
+}
+
+func TestWindowContains(t *testing.T) {
+	tokyo, err := time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := func(hour, min int) time.Time {
+		return time.Date(2021, 9, 1, hour, min, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		name   string
+		window string
+		t      time.Time
+		want   bool
+	}{
+		{"before start", "9-17", at(8, 59), false},
+		{"at start", "9-17", at(9, 0), true},
+		{"inside", "9-17", at(12, 30), true},
+		{"in the finish hour", "9-17", at(17, 59), true},
+		{"after the finish hour", "9-17", at(18, 0), false},
+		{"at a minute finish", "9:00-17:30", at(17, 30), false},
+		{"before a minute finish", "9:00-17:30", at(17, 29), true},
+		{"wrapping, before midnight", "22:00-6:00", at(23, 15), true},
+		{"wrapping, after midnight", "22:00-6:00", at(3, 0), true},
+		{"wrapping, in the finish hour", "22:00-6:00", at(6, 59), true},
+		{"wrapping, outside", "22:00-6:00", at(12, 0), false},
+		{"wrapping, before start", "22:00-6:00", at(21, 59), false},
+		{"until midnight", "18-0", at(0, 30), true},
+		{"until midnight, outside", "18-0", at(1, 0), false},
+		// 9-17 in Tokyo is 0-8 UTC
+		{"timezone inside", "9-17@Asia/Tokyo", at(0, 0), true},
+		{"timezone finish hour", "9-17@Asia/Tokyo", at(8, 59), true},
+		{"timezone outside", "9-17@Asia/Tokyo", at(12, 0), false},
+		{"timezone of t ignored", "9-17@Asia/Tokyo", at(3, 0).In(tokyo), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, err := ParseWindow(tt.window, "UTC")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := w.Contains(tt.t); got != tt.want {
+				t.Errorf("%s.Contains(%s) = %v, want %v", w, tt.t, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWindowsContains(t *testing.T) {
+	var ws Windows
+	for _, s := range []string{"9-11", "22:00-2:00@Asia/Tokyo"} {
+		w, err := ParseWindow(s, "UTC")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ws = append(ws, w)
+	}
+
+	tests := []struct {
+		t    time.Time
+		want bool
+	}{
+		{time.Date(2021, 9, 1, 10, 0, 0, 0, time.UTC), true},
+		// 22:00-2:59 in Tokyo is 13:00-17:59 UTC
+		{time.Date(2021, 9, 1, 14, 0, 0, 0, time.UTC), true},
+		{time.Date(2021, 9, 1, 18, 0, 0, 0, time.UTC), false},
+		{time.Date(2021, 9, 1, 8, 0, 0, 0, time.UTC), false},
+	}
+	for _, tt := range tests {
+		if got := ws.Contains(tt.t); got != tt.want {
+			t.Errorf("Contains(%s) = %v, want %v", tt.t, got, tt.want)
+		}
+	}
+
+	if (Windows{}).Contains(tests[0].t) {
+		t.Error("no windows contain a time")
+	}
+}